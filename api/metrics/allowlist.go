@@ -0,0 +1,123 @@
+/*
+Copyright 2020 The Operator-SDK Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Allowlist maps a resource, e.g. memcacheds, to the Kubernetes label or
+// annotation keys that may be exposed as metric labels for it. There is no
+// denylist: without wildcards no key outside the allowlist is exposed, so
+// there is nothing for one to remove.
+type Allowlist map[string][]string
+
+// allowlistPattern matches one resource=[key,...] entry.
+var allowlistPattern = regexp.MustCompile(`^\s*([a-z0-9.-]+)\s*=\s*\[([^\]]*)\]\s*`)
+
+// ParseAllowlist parses a comma separated list of resource=[key,...]
+// entries, such as memcacheds=[team,env],pods=[app]. Keys of a resource
+// listed more than once are merged. Wildcards are not supported, since
+// every exposed key becomes a metric label.
+func ParseAllowlist(s string) (Allowlist, error) {
+	allowlist := Allowlist{}
+	rest := strings.TrimSpace(s)
+	for rest != "" {
+		m := allowlistPattern.FindStringSubmatch(rest)
+		if m == nil {
+			return nil, fmt.Errorf("invalid allowlist %q: expected resource=[key,...]", s)
+		}
+		resource := m[1]
+		for _, key := range strings.Split(m[2], ",") {
+			key = strings.TrimSpace(key)
+			if key == "" {
+				continue
+			}
+			if key == "*" {
+				return nil, fmt.Errorf("invalid allowlist %q: wildcards are not supported", s)
+			}
+			allowlist[resource] = append(allowlist[resource], key)
+		}
+		if _, ok := allowlist[resource]; !ok {
+			allowlist[resource] = nil
+		}
+		rest = strings.TrimSpace(rest[len(m[0]):])
+		if rest != "" {
+			if rest[0] != ',' {
+				return nil, fmt.Errorf("invalid allowlist %q: expected resource=[key,...]", s)
+			}
+			rest = rest[1:]
+		}
+	}
+	return allowlist, nil
+}
+
+// allowedLabels returns the sorted, deduplicated keys of an allowlist with
+// the label name exposing each one: prefix plus the key with characters
+// invalid in label names replaced by underscores. Keys that sanitize to the
+// same name are told apart by a _conflictN suffix, numbered in key order so
+// names are stable across restarts and skipping names already in use.
+func allowedLabels(prefix string, allowlist []string) (keys, names []string) {
+	seen := map[string]bool{}
+	for _, k := range allowlist {
+		if !seen[k] {
+			seen[k] = true
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	byName := map[string][]int{}
+	taken := map[string]bool{}
+	names = make([]string, len(keys))
+	for i, k := range keys {
+		names[i] = prefix + sanitizeLabelName(k)
+		byName[names[i]] = append(byName[names[i]], i)
+		taken[names[i]] = true
+	}
+	conflicts := make([]string, 0, len(byName))
+	for name, indexes := range byName {
+		if len(indexes) > 1 {
+			conflicts = append(conflicts, name)
+		}
+	}
+	sort.Strings(conflicts)
+	for _, name := range conflicts {
+		n := 1
+		for _, i := range byName[name] {
+			for taken[name+"_conflict"+strconv.Itoa(n)] {
+				n++
+			}
+			names[i] = name + "_conflict" + strconv.Itoa(n)
+			taken[names[i]] = true
+			n++
+		}
+	}
+	return keys, names
+}
+
+// sanitizeLabelName replaces the characters of s that are not valid in a
+// Prometheus label name with underscores.
+func sanitizeLabelName(s string) string {
+	return invalidLabelChars.ReplaceAllString(s, "_")
+}
+
+var invalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
@@ -0,0 +1,87 @@
+/*
+Copyright 2020 The Operator-SDK Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+var _ = Describe("ParseAllowlist", func() {
+	It("parses keys per resource", func() {
+		allowlist, err := ParseAllowlist("memcacheds=[team, env],pods=[app.kubernetes.io/name],memcacheds=[tier]")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(allowlist).To(Equal(Allowlist{
+			"memcacheds": {"team", "env", "tier"},
+			"pods":       {"app.kubernetes.io/name"},
+		}))
+	})
+
+	It("accepts an empty list", func() {
+		allowlist, err := ParseAllowlist("")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(allowlist).To(BeEmpty())
+	})
+
+	It("rejects malformed entries and wildcards", func() {
+		for _, s := range []string{"memcacheds", "memcacheds=team", "memcacheds=[team] pods=[app]", "memcacheds=[*]"} {
+			_, err := ParseAllowlist(s)
+			Expect(err).To(HaveOccurred(), s)
+		}
+	})
+})
+
+var _ = Describe("allowedLabels", func() {
+	It("sanitizes keys into label names", func() {
+		keys, names := allowedLabels("label_", []string{"team", "app.kubernetes.io/name", "team"})
+		Expect(keys).To(Equal([]string{"app.kubernetes.io/name", "team"}))
+		Expect(names).To(Equal([]string{"label_app_kubernetes_io_name", "label_team"}))
+	})
+
+	It("suffixes keys that sanitize to the same name in key order", func() {
+		keys, names := allowedLabels("label_", []string{"team.name", "team-name", "env"})
+		Expect(keys).To(Equal([]string{"env", "team-name", "team.name"}))
+		Expect(names).To(Equal([]string{"label_env", "label_team_name_conflict1", "label_team_name_conflict2"}))
+	})
+
+	It("skips suffixed names that are already in use", func() {
+		keys, names := allowedLabels("label_", []string{"a.b", "a-b", "a_b_conflict1"})
+		Expect(keys).To(Equal([]string{"a-b", "a.b", "a_b_conflict1"}))
+		Expect(names).To(Equal([]string{"label_a_b_conflict2", "label_a_b_conflict3", "label_a_b_conflict1"}))
+
+		Expect(func() {
+			NewRegistry().MustRegister(NewMemcachedCollector(MemcachedCollectorOptions{
+				LabelsAllowlist: []string{"a.b", "a-b", "a_b_conflict1"},
+			}))
+		}).NotTo(Panic())
+	})
+
+	It("lets a collector expose conflicting keys side by side", func() {
+		registry := NewRegistry()
+		registry.MustRegister(NewMemcachedCollector(MemcachedCollectorOptions{
+			LabelsAllowlist: []string{"team.name", "team-name"},
+		}))
+		obj := newMemcached("example")
+		obj.Labels = map[string]string{"team.name": "a", "team-name": "b"}
+		registry.Predicate().Create(event.CreateEvent{Meta: obj, Object: obj})
+
+		Expect(familySeries(registry, "memcached_labels")).To(Equal(map[string]float64{
+			"label_team_name_conflict1=b,label_team_name_conflict2=a,memcached=example,namespace=default": 1,
+		}))
+	})
+})
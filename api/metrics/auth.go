@@ -0,0 +1,147 @@
+/*
+Copyright 2020 The Operator-SDK Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const defaultAuthCacheTTL = time.Minute
+
+// TokenAuthenticator protects the metrics server the way kube-rbac-proxy
+// protects the manager's metrics: the bearer token of each request is
+// authenticated with a TokenReview, and the requester must be allowed to
+// GET the request path by a SubjectAccessReview. Decisions are cached per
+// token and path for TTL to spare the API server on every scrape.
+type TokenAuthenticator struct {
+	Client kubernetes.Interface
+	// TTL is how long a decision is cached. Defaults to one minute.
+	TTL time.Duration
+
+	mu        sync.Mutex
+	decisions map[authKey]authDecision
+}
+
+type authKey struct {
+	token string
+	path  string
+}
+
+type authDecision struct {
+	status  int
+	expires time.Time
+}
+
+// Wrap returns a handler that only passes authorized requests to next.
+func (a *TokenAuthenticator) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		status := a.authorize(req)
+		if status != http.StatusOK {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// authorize returns http.StatusOK for authorized requests, or the status to
+// reject the request with.
+func (a *TokenAuthenticator) authorize(req *http.Request) int {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return http.StatusUnauthorized
+	}
+	key := authKey{token: strings.TrimPrefix(auth, "Bearer "), path: req.URL.Path}
+
+	now := time.Now()
+	a.mu.Lock()
+	if d, ok := a.decisions[key]; ok && now.Before(d.expires) {
+		a.mu.Unlock()
+		return d.status
+	}
+	a.mu.Unlock()
+
+	status, err := a.review(req.Context(), key)
+	if err != nil {
+		// Errors talking to the API server are not cached.
+		log.Error(err, "unable to review metrics request", "path", key.path)
+		return http.StatusInternalServerError
+	}
+
+	ttl := a.TTL
+	if ttl <= 0 {
+		ttl = defaultAuthCacheTTL
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.decisions == nil {
+		a.decisions = map[authKey]authDecision{}
+	}
+	for k, d := range a.decisions {
+		if now.After(d.expires) {
+			delete(a.decisions, k)
+		}
+	}
+	a.decisions[key] = authDecision{status: status, expires: now.Add(ttl)}
+	return status
+}
+
+func (a *TokenAuthenticator) review(ctx context.Context, key authKey) (int, error) {
+	tr, err := a.Client.AuthenticationV1().TokenReviews().Create(ctx, &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: key.token},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return 0, err
+	}
+	if !tr.Status.Authenticated {
+		return http.StatusUnauthorized, nil
+	}
+
+	user := tr.Status.User
+	extra := make(map[string]authorizationv1.ExtraValue, len(user.Extra))
+	for k, v := range user.Extra {
+		extra[k] = authorizationv1.ExtraValue(v)
+	}
+	sar, err := a.Client.AuthorizationV1().SubjectAccessReviews().Create(ctx, &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:   user.Username,
+			UID:    user.UID,
+			Groups: user.Groups,
+			Extra:  extra,
+			NonResourceAttributes: &authorizationv1.NonResourceAttributes{
+				Path: key.path,
+				Verb: "get",
+			},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return 0, err
+	}
+	if !sar.Status.Allowed {
+		return http.StatusForbidden, nil
+	}
+	return http.StatusOK, nil
+}
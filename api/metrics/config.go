@@ -0,0 +1,109 @@
+/*
+Copyright 2020 The Operator-SDK Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/yaml"
+)
+
+// Config is the format of the file passed to --metrics-config. It lists the
+// metric families to generate from watched custom resources.
+type Config struct {
+	Metrics []FamilyConfig `json:"metrics"`
+}
+
+// LoadConfig reads and parses the metrics configuration file at path.
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(data)
+}
+
+// ParseConfig parses a YAML or JSON metrics configuration.
+func ParseConfig(data []byte) (*Config, error) {
+	cfg := &Config{}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, fmt.Errorf("unable to parse metrics config: %v", err)
+	}
+	return cfg, nil
+}
+
+// Collectors compiles every family in the configuration. The scheme is used
+// to resolve the kind of typed objects that arrive without TypeMeta.
+func (c *Config) Collectors(scheme *runtime.Scheme) ([]*FamilyCollector, error) {
+	seen := map[string]bool{}
+	collectors := make([]*FamilyCollector, 0, len(c.Metrics))
+	for _, m := range c.Metrics {
+		if seen[m.Name] {
+			return nil, fmt.Errorf("metric family %q is defined more than once", m.Name)
+		}
+		seen[m.Name] = true
+
+		fc, err := NewFamilyCollector(m)
+		if err != nil {
+			return nil, err
+		}
+		fc.scheme = scheme
+		collectors = append(collectors, fc)
+	}
+	return collectors, nil
+}
+
+// GroupVersionKinds returns the distinct kinds the families are generated
+// from, in order of first use.
+func (c *Config) GroupVersionKinds() []schema.GroupVersionKind {
+	seen := map[schema.GroupVersionKind]bool{}
+	var gvks []schema.GroupVersionKind
+	for _, m := range c.Metrics {
+		if m.GroupVersionKind == nil {
+			continue
+		}
+		gvk := schema.GroupVersionKind{Group: m.GroupVersionKind.Group, Version: m.GroupVersionKind.Version, Kind: m.GroupVersionKind.Kind}
+		if !seen[gvk] {
+			seen[gvk] = true
+			gvks = append(gvks, gvk)
+		}
+	}
+	return gvks
+}
+
+// CheckKinds returns an error naming the first family generated from a kind
+// missing from watched. Such a family would only ever see the objects it was
+// seeded with, and the next resync would delete their series.
+func (c *Config) CheckKinds(watched []schema.GroupVersionKind) error {
+	ok := map[schema.GroupVersionKind]bool{}
+	for _, gvk := range watched {
+		ok[gvk] = true
+	}
+	for _, m := range c.Metrics {
+		if m.GroupVersionKind == nil {
+			continue
+		}
+		gvk := schema.GroupVersionKind{Group: m.GroupVersionKind.Group, Version: m.GroupVersionKind.Version, Kind: m.GroupVersionKind.Kind}
+		if !ok[gvk] {
+			return fmt.Errorf("metric family %q: kind %s is not watched; add it to --metrics-watch-kinds or restart the operator to pick it up from the config", m.Name, gvk)
+		}
+	}
+	return nil
+}
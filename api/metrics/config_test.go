@@ -0,0 +1,94 @@
+/*
+Copyright 2020 The Operator-SDK Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var _ = Describe("ParseConfig", func() {
+	It("parses families", func() {
+		cfg, err := ParseConfig([]byte(`
+metrics:
+- name: memcached_team_info
+  type: info
+  groupVersionKind: {group: cache.example.com, version: v1alpha1, kind: Memcached}
+  labels:
+  - name: team
+    path: .metadata.labels.team
+`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.Metrics).To(Equal([]FamilyConfig{{
+			Name:             "memcached_team_info",
+			Type:             MetricTypeInfo,
+			GroupVersionKind: &GroupVersionKind{Group: "cache.example.com", Version: "v1alpha1", Kind: "Memcached"},
+			Labels:           []LabelConfig{{Name: "team", Path: ".metadata.labels.team"}},
+		}}))
+	})
+
+	It("rejects unknown fields", func() {
+		_, err := ParseConfig([]byte(`
+metrics:
+- name: memcached_team_info
+  type: info
+  lables: []
+`))
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("Config", func() {
+	memcached := &GroupVersionKind{Group: "cache.example.com", Version: "v1alpha1", Kind: "Memcached"}
+	redis := &GroupVersionKind{Group: "cache.example.com", Version: "v1alpha1", Kind: "Redis"}
+
+	It("rejects families defined more than once", func() {
+		cfg := &Config{Metrics: []FamilyConfig{
+			{Name: "dup", Type: MetricTypeInfo},
+			{Name: "dup", Type: MetricTypeInfo},
+		}}
+		_, err := cfg.Collectors(nil)
+		Expect(err).To(MatchError(ContainSubstring(`"dup" is defined more than once`)))
+	})
+
+	It("lists the distinct kinds of its families", func() {
+		cfg := &Config{Metrics: []FamilyConfig{
+			{Name: "a", Type: MetricTypeInfo, GroupVersionKind: memcached},
+			{Name: "b", Type: MetricTypeInfo},
+			{Name: "c", Type: MetricTypeInfo, GroupVersionKind: redis},
+			{Name: "d", Type: MetricTypeInfo, GroupVersionKind: memcached},
+		}}
+		Expect(cfg.GroupVersionKinds()).To(Equal([]schema.GroupVersionKind{
+			{Group: "cache.example.com", Version: "v1alpha1", Kind: "Memcached"},
+			{Group: "cache.example.com", Version: "v1alpha1", Kind: "Redis"},
+		}))
+	})
+
+	It("rejects families for kinds that are not watched", func() {
+		cfg := &Config{Metrics: []FamilyConfig{
+			{Name: "a", Type: MetricTypeInfo, GroupVersionKind: memcached},
+			{Name: "b", Type: MetricTypeInfo},
+			{Name: "c", Type: MetricTypeInfo, GroupVersionKind: redis},
+		}}
+		watched := []schema.GroupVersionKind{{Group: "cache.example.com", Version: "v1alpha1", Kind: "Memcached"}}
+		Expect(cfg.CheckKinds(watched)).To(MatchError(ContainSubstring(`"c"`)))
+
+		watched = append(watched, schema.GroupVersionKind{Group: "cache.example.com", Version: "v1alpha1", Kind: "Redis"})
+		Expect(cfg.CheckKinds(watched)).To(Succeed())
+	})
+})
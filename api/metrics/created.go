@@ -0,0 +1,106 @@
+/*
+Copyright 2020 The Operator-SDK Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// createdCounterVec is a CounterVec that also exposes the Unix time each of
+// its series was created, as the gauge family foo_created for a counter
+// named foo_total. client_golang v1.12.2 cannot attach _created samples to
+// counters itself, so they are exposed the way the text format of other
+// client libraries does.
+type createdCounterVec struct {
+	vec  *prometheus.CounterVec
+	desc *prometheus.Desc
+
+	mu      sync.Mutex
+	created map[string]createdSeries
+}
+
+type createdSeries struct {
+	labelValues []string
+	at          float64
+}
+
+func newCreatedCounterVec(opts prometheus.CounterOpts, labelNames []string) *createdCounterVec {
+	name := prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name)
+	return &createdCounterVec{
+		vec: prometheus.NewCounterVec(opts, labelNames),
+		desc: prometheus.NewDesc(strings.TrimSuffix(name, "_total")+"_created",
+			"Unix creation time of the "+name+" series.", labelNames, opts.ConstLabels),
+		created: map[string]createdSeries{},
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *createdCounterVec) Describe(ch chan<- *prometheus.Desc) {
+	c.vec.Describe(ch)
+	ch <- c.desc
+}
+
+// Collect implements prometheus.Collector.
+func (c *createdCounterVec) Collect(ch chan<- prometheus.Metric) {
+	c.vec.Collect(ch)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, s := range c.created {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, s.at, s.labelValues...)
+	}
+}
+
+// GetMetricWithLabelValues is like CounterVec.GetMetricWithLabelValues and
+// records the creation time of new series.
+func (c *createdCounterVec) GetMetricWithLabelValues(lvs ...string) (prometheus.Counter, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counter, err := c.vec.GetMetricWithLabelValues(lvs...)
+	if err != nil {
+		return nil, err
+	}
+	key := seriesKey(lvs)
+	if _, ok := c.created[key]; !ok {
+		c.created[key] = createdSeries{
+			labelValues: append([]string(nil), lvs...),
+			at:          float64(time.Now().UnixNano()) / 1e9,
+		}
+	}
+	return counter, nil
+}
+
+// WithLabelValues is like CounterVec.WithLabelValues and records the
+// creation time of new series.
+func (c *createdCounterVec) WithLabelValues(lvs ...string) prometheus.Counter {
+	counter, err := c.GetMetricWithLabelValues(lvs...)
+	if err != nil {
+		panic(err)
+	}
+	return counter
+}
+
+// DeleteLabelValues deletes a series along with its creation time.
+func (c *createdCounterVec) DeleteLabelValues(lvs ...string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.created, seriesKey(lvs))
+	return c.vec.DeleteLabelValues(lvs...)
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2020 The Operator-SDK Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"fmt"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+var _ = Describe("createdCounterVec", func() {
+	var (
+		registry *prometheus.Registry
+		vec      *createdCounterVec
+	)
+
+	BeforeEach(func() {
+		registry = prometheus.NewRegistry()
+		vec = newCreatedCounterVec(prometheus.CounterOpts{Name: "widgets_total", Help: "Widgets."}, []string{"kind"})
+		registry.MustRegister(vec)
+	})
+
+	It("exposes the creation time of each series", func() {
+		before := float64(time.Now().Unix())
+		vec.WithLabelValues("a").Inc()
+		created := familySeries(registry, "widgets_created")
+		Expect(created).To(HaveKeyWithValue("kind=a", BeNumerically(">=", before)))
+
+		time.Sleep(10 * time.Millisecond)
+		vec.WithLabelValues("a").Inc()
+		Expect(familySeries(registry, "widgets_created")).To(Equal(created))
+		Expect(testutil.ToFloat64(vec.WithLabelValues("a"))).To(Equal(float64(2)))
+	})
+
+	It("forgets the creation time of deleted series", func() {
+		vec.WithLabelValues("a").Inc()
+		vec.WithLabelValues("b").Inc()
+
+		Expect(vec.DeleteLabelValues("a")).To(BeTrue())
+		Expect(familySeries(registry, "widgets_created")).To(HaveLen(1))
+		Expect(familySeries(registry, "widgets_created")).To(HaveKey("kind=b"))
+	})
+
+	It("records nothing for invalid label values", func() {
+		_, err := vec.GetMetricWithLabelValues("a", "b")
+		Expect(err).To(HaveOccurred())
+		Expect(gatheredFamily(registry, "widgets_created")).To(BeNil())
+	})
+})
+
+var _ = Describe("_created series", func() {
+	It("are exposed for the operator's own counters", func() {
+		registry := NewDefaultRegistry()
+		rm := NewReconcileMetrics()
+		registry.MustRegister(rm)
+		registry.MustRegister(&panickingCollector{Gauge: prometheus.NewGauge(prometheus.GaugeOpts{Name: "broken", Help: "broken"})})
+
+		rm.ObserveResult("default", "example", nil, ReconcileSuccess)
+		RecordError("example", fmt.Errorf("example"))
+		obj := newMemcached("example")
+		registry.Predicate().Update(event.UpdateEvent{MetaOld: obj, ObjectOld: obj, MetaNew: obj, ObjectNew: obj})
+
+		for _, name := range []string{"memcached_reconcile_created", "metrics_errors_created", "metrics_handler_failures_created"} {
+			Expect(gatheredFamily(registry, name)).NotTo(BeNil(), name)
+		}
+	})
+})
@@ -0,0 +1,114 @@
+/*
+Copyright 2020 The Operator-SDK Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// CollectorInfo describes a registered collector for debugging.
+type CollectorInfo struct {
+	// Name is the collector's name in the handler metrics.
+	Name string `json:"name"`
+	// Type is the Go type of the collector.
+	Type string `json:"type"`
+	// Handles lists the event handler and filter interfaces it implements.
+	Handles []string `json:"handles"`
+	// Series is the number of series it currently exposes.
+	Series int `json:"series"`
+}
+
+// Collectors describes every collector registered through the registry, in
+// registration order.
+func (r *Registry) Collectors() []CollectorInfo {
+	r.mu.Lock()
+	metrics := append([]registeredCollector(nil), r.metrics...)
+	r.mu.Unlock()
+
+	infos := make([]CollectorInfo, 0, len(metrics))
+	for _, m := range metrics {
+		infos = append(infos, CollectorInfo{
+			Name:    m.name,
+			Type:    fmt.Sprintf("%T", m.Collector),
+			Handles: handledEvents(m.Collector),
+			Series:  countSeries(m.Collector),
+		})
+	}
+	return infos
+}
+
+func handledEvents(c prometheus.Collector) []string {
+	handles := []string{}
+	add := func(ok bool, name string) {
+		if ok {
+			handles = append(handles, name)
+		}
+	}
+	_, ok := c.(CreateEventHandler)
+	add(ok, createEvent)
+	_, ok = c.(UpdateEventHandler)
+	add(ok, updateEvent)
+	_, ok = c.(DeleteEventHandler)
+	add(ok, deleteEvent)
+	_, ok = c.(GenericEventHandler)
+	add(ok, genericEvent)
+	_, ok = c.(ResyncHandler)
+	add(ok, resyncEvent)
+	_, ok = c.(CreateEventFilter)
+	add(ok, "filter_"+createEvent)
+	_, ok = c.(UpdateEventFilter)
+	add(ok, "filter_"+updateEvent)
+	_, ok = c.(DeleteEventFilter)
+	add(ok, "filter_"+deleteEvent)
+	_, ok = c.(GenericEventFilter)
+	add(ok, "filter_"+genericEvent)
+	return handles
+}
+
+func countSeries(c prometheus.Collector) int {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+	n := 0
+	for range ch {
+		n++
+	}
+	return n
+}
+
+// collectorLister is implemented by gatherers that can describe their
+// collectors, such as Registry.
+type collectorLister interface {
+	Collectors() []CollectorInfo
+}
+
+func collectorsHandler(l collectorLister) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(l.Collectors()); err != nil {
+			log.Error(err, "unable to write collectors")
+		}
+	})
+}
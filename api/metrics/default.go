@@ -17,38 +17,120 @@ limitations under the License.
 package metrics
 
 import (
-	"fmt"
-
 	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"sigs.k8s.io/controller-runtime/pkg/event"
 )
 
+// CRInfoGauge exposes custom_resource_info with the creation time as a
+// string label.
+//
+// Deprecated: use memcached_info and memcached_created from
+// MemcachedCollector. CRInfoGauge will be removed in the next release.
 type CRInfoGauge struct {
 	*prometheus.GaugeVec
 }
 
+// TimeInfo exposes memcached_last_reconcile_timestamp_seconds, the time a
+// Memcached was last reconciled, and optionally the same value under the
+// deprecated size_info name.
 type TimeInfo struct {
-	*prometheus.GaugeVec
+	lastReconcile *prometheus.GaugeVec
+	// legacy is the deprecated size_info family, nil unless enabled.
+	legacy *prometheus.GaugeVec
 }
 
-type SummaryInfo struct {
-	*prometheus.GaugeVec
+// TimeInfoOptions configures a TimeInfo.
+type TimeInfoOptions struct {
+	// LegacySizeInfo keeps exporting size_info alongside
+	// memcached_last_reconcile_timestamp_seconds.
+	LegacySizeInfo bool
 }
 
-func NewSummaryInfo() *SummaryInfo {
-	return &SummaryInfo{
-		prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Name: "summary_info",
-			Help: fmt.Sprintf("Information about the custom resource summary."),
-		}, []string{"namespace", "name", "apiversion", "kind"}),
+func NewTimeInfo(opts TimeInfoOptions) *TimeInfo {
+	t := &TimeInfo{
+		lastReconcile: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "memcached_last_reconcile_timestamp_seconds",
+			Help: "Unix time of the last reconcile of a Memcached.",
+		}, memcachedLabels),
 	}
-}
-func NewTimeInfo() *TimeInfo {
-	return &TimeInfo{
-		prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	if opts.LegacySizeInfo {
+		t.legacy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 			Name: "size_info",
-			Help: fmt.Sprintf("Information about the custom resources size"),
-		}, []string{"namespace", "name"}),
+			Help: "Deprecated: use memcached_last_reconcile_timestamp_seconds. Unix time of the last reconcile of a custom resource.",
+		}, []string{"namespace", "name"})
+	}
+	return t
+}
+
+// Describe implements prometheus.Collector.
+func (t *TimeInfo) Describe(ch chan<- *prometheus.Desc) {
+	t.lastReconcile.Describe(ch)
+	if t.legacy != nil {
+		t.legacy.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (t *TimeInfo) Collect(ch chan<- prometheus.Metric) {
+	t.lastReconcile.Collect(ch)
+	if t.legacy != nil {
+		t.legacy.Collect(ch)
+	}
+}
+
+// SetLastReconcile sets the last reconcile time of the named object to now.
+// It does nothing on a nil TimeInfo.
+func (t *TimeInfo) SetLastReconcile(namespace, name string) {
+	if t == nil {
+		return
+	}
+	g, err := t.lastReconcile.GetMetricWithLabelValues(namespace, name)
+	if err != nil {
+		RecordError("memcached_last_reconcile_timestamp_seconds", err, "namespace", namespace, "name", name)
+		return
+	}
+	g.SetToCurrentTime()
+	if t.legacy == nil {
+		return
+	}
+	g, err = t.legacy.GetMetricWithLabelValues(namespace, name)
+	if err != nil {
+		RecordError("size_info", err, "namespace", namespace, "name", name)
+		return
+	}
+	g.SetToCurrentTime()
+}
+
+// Delete removes the series of a deleted Memcached.
+func (t *TimeInfo) Delete(e event.DeleteEvent) {
+	if _, ok := toMemcached(e.Object); !ok {
+		return
+	}
+	namespace, name := e.Meta.GetNamespace(), e.Meta.GetName()
+	t.lastReconcile.DeleteLabelValues(namespace, name)
+	if t.legacy != nil {
+		t.legacy.DeleteLabelValues(namespace, name)
+	}
+}
+
+// ResyncKinds implements KindedResyncHandler.
+func (t *TimeInfo) ResyncKinds() []schema.GroupVersionKind {
+	return []schema.GroupVersionKind{memcachedGVK}
+}
+
+// Resync deletes the series of Memcacheds that no longer exist. The
+// timestamps of existing ones are only set by reconciles.
+func (t *TimeInfo) Resync(objs []runtime.Object) {
+	keys := memcachedKeys(objs)
+	pruneGaugeVec(t.lastReconcile, func(l map[string]string) bool {
+		return keys[objectKey(l["namespace"], l["memcached"])]
+	})
+	if t.legacy != nil {
+		pruneGaugeVec(t.legacy, func(l map[string]string) bool {
+			return keys[objectKey(l["namespace"], l["name"])]
+		})
 	}
 }
 
@@ -56,26 +138,29 @@ func NewCRInfoGauge() *CRInfoGauge {
 	return &CRInfoGauge{
 		prometheus.NewGaugeVec(prometheus.GaugeOpts{
 			Name: "custom_resource_info",
-			Help: fmt.Sprintf("Information about the custom resources"),
+			Help: "Deprecated: use memcached_info and memcached_created. Information about the custom resources.",
 		}, []string{"namespace", "name", "created"}),
 	}
 }
 
+// Create sets the series of a created Memcached. Objects of other kinds are
+// ignored, since the series carry no kind.
 func (vec *CRInfoGauge) Create(e event.CreateEvent) {
-	name := e.Meta.GetName()
-	namespace := e.Meta.GetNamespace()
-	created := e.Meta.GetCreationTimestamp().String()
-	vec.set(name, namespace, created)
+	if m, ok := toMemcached(e.Object); ok {
+		vec.set(m.Name, m.Namespace, m.CreationTimestamp.String())
+	}
 }
 
 func (vec *CRInfoGauge) Update(e event.UpdateEvent) {
-	name := e.MetaNew.GetName()
-	namespace := e.MetaNew.GetNamespace()
-	created := e.MetaNew.GetCreationTimestamp().String()
-	vec.set(name, namespace, created)
+	if m, ok := toMemcached(e.ObjectNew); ok {
+		vec.set(m.Name, m.Namespace, m.CreationTimestamp.String())
+	}
 }
 
 func (vec *CRInfoGauge) Delete(e event.DeleteEvent) {
+	if _, ok := toMemcached(e.Object); !ok {
+		return
+	}
 	vec.GaugeVec.Delete(map[string]string{
 		"name":      e.Meta.GetName(),
 		"namespace": e.Meta.GetNamespace(),
@@ -83,6 +168,28 @@ func (vec *CRInfoGauge) Delete(e event.DeleteEvent) {
 	})
 }
 
+// ResyncKinds implements KindedResyncHandler.
+func (vec *CRInfoGauge) ResyncKinds() []schema.GroupVersionKind {
+	return []schema.GroupVersionKind{memcachedGVK}
+}
+
+// Resync sets the series of every Memcached and deletes all others.
+func (vec *CRInfoGauge) Resync(objs []runtime.Object) {
+	want := map[string]bool{}
+	for _, obj := range objs {
+		m, ok := toMemcached(obj)
+		if !ok {
+			continue
+		}
+		created := m.CreationTimestamp.String()
+		want[objectKey(m.Namespace, m.Name)+"/"+created] = true
+		vec.set(m.Name, m.Namespace, created)
+	}
+	pruneGaugeVec(vec.GaugeVec, func(l map[string]string) bool {
+		return want[objectKey(l["namespace"], l["name"])+"/"+l["created"]]
+	})
+}
+
 func (vec *CRInfoGauge) set(name, namespace, created string) {
 	labels := map[string]string{
 		"name":      name,
@@ -91,12 +198,28 @@ func (vec *CRInfoGauge) set(name, namespace, created string) {
 	}
 	m, err := vec.GaugeVec.GetMetricWith(labels)
 	if err != nil {
-		panic(err)
+		RecordError("custom_resource_info", err, "namespace", namespace, "name", name)
+		return
 	}
 	m.Set(1)
 }
 
+// metricsErrors counts failures to record a custom resource metric. It is
+// registered by NewDefaultRegistry.
+var metricsErrors = newCreatedCounterVec(prometheus.CounterOpts{
+	Name: "metrics_errors_total",
+	Help: "Number of errors encountered while recording custom resource metrics.",
+}, []string{"metric"})
+
+// RecordError logs a failure to record the named metric and counts it in
+// metrics_errors_total. Failing to record a metric never fails the caller.
+func RecordError(metric string, err error, keysAndValues ...interface{}) {
+	log.Error(err, "unable to record metric", append([]interface{}{"metric", metric}, keysAndValues...)...)
+	metricsErrors.WithLabelValues(metric).Inc()
+}
+
 func NewDefaultRegistry() RegistererGathererPredicater {
 	r := NewRegistry()
+	r.MustRegister(metricsErrors)
 	return r
 }
@@ -0,0 +1,119 @@
+/*
+Copyright 2020 The Operator-SDK Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+var _ = Describe("CRInfoGauge", func() {
+	It("counts invalid label values instead of panicking", func() {
+		registry := NewDefaultRegistry()
+		registry.MustRegister(NewCRInfoGauge())
+		before := testutil.ToFloat64(metricsErrors.WithLabelValues("custom_resource_info"))
+
+		obj := newMemcached("invalid-\xff")
+		Expect(func() {
+			registry.Predicate().Create(event.CreateEvent{Meta: obj, Object: obj})
+		}).NotTo(Panic())
+
+		Expect(testutil.ToFloat64(metricsErrors.WithLabelValues("custom_resource_info"))).To(Equal(before + 1))
+	})
+
+	It("ignores objects of other kinds", func() {
+		registry := NewRegistry()
+		registry.MustRegister(NewCRInfoGauge())
+		cm := newConfigMap("settings")
+		registry.Predicate().Create(event.CreateEvent{Meta: cm, Object: cm})
+		Expect(familySeries(registry, "custom_resource_info")).To(BeEmpty())
+
+		obj := newMemcached("example")
+		registry.Resync([]runtime.Object{obj, cm})
+		Expect(familySeries(registry, "custom_resource_info")).To(HaveLen(1))
+		for key := range familySeries(registry, "custom_resource_info") {
+			Expect(key).To(HaveSuffix("name=example,namespace=default"))
+		}
+	})
+
+	It("marks custom_resource_info as deprecated", func() {
+		registry := NewRegistry()
+		registry.MustRegister(NewCRInfoGauge())
+		obj := newMemcached("example")
+		registry.Predicate().Create(event.CreateEvent{Meta: obj, Object: obj})
+
+		Expect(gatheredFamily(registry, "custom_resource_info").GetHelp()).To(HavePrefix("Deprecated: use memcached_info and memcached_created."))
+	})
+})
+
+var _ = Describe("TimeInfo", func() {
+	It("exposes the last reconcile time under both names with the old one deprecated", func() {
+		registry := NewRegistry()
+		timeInfo := NewTimeInfo(TimeInfoOptions{LegacySizeInfo: true})
+		registry.MustRegister(timeInfo)
+		before := float64(time.Now().Unix())
+
+		timeInfo.SetLastReconcile("default", "example")
+
+		current := gatheredFamily(registry, "memcached_last_reconcile_timestamp_seconds")
+		Expect(familySeries(registry, "memcached_last_reconcile_timestamp_seconds")).To(HaveKey("memcached=example,namespace=default"))
+		Expect(current.GetMetric()[0].GetGauge().GetValue()).To(BeNumerically(">=", before))
+		Expect(current.GetHelp()).NotTo(ContainSubstring("Deprecated"))
+
+		legacy := gatheredFamily(registry, "size_info")
+		Expect(legacy.GetHelp()).To(HavePrefix("Deprecated:"))
+		Expect(familySeries(registry, "size_info")).To(HaveKeyWithValue("name=example,namespace=default", BeNumerically(">=", before)))
+	})
+
+	It("prunes a deleted Memcached even if an object of another kind shares its name", func() {
+		registry := NewRegistry()
+		timeInfo := NewTimeInfo(TimeInfoOptions{LegacySizeInfo: true})
+		registry.MustRegister(timeInfo)
+		timeInfo.SetLastReconcile("default", "example")
+
+		registry.Resync([]runtime.Object{newConfigMap("example")})
+
+		Expect(gatheredNames(registry)).To(BeEmpty())
+	})
+
+	It("exposes only the new family when the legacy one is disabled", func() {
+		registry := NewRegistry()
+		timeInfo := NewTimeInfo(TimeInfoOptions{})
+		registry.MustRegister(timeInfo)
+
+		timeInfo.SetLastReconcile("default", "example")
+
+		Expect(gatheredNames(registry)).To(Equal([]string{"memcached_last_reconcile_timestamp_seconds"}))
+	})
+
+	It("deletes the series of a deleted Memcached, including from tombstones", func() {
+		registry := NewRegistry()
+		timeInfo := NewTimeInfo(TimeInfoOptions{LegacySizeInfo: true})
+		registry.MustRegister(timeInfo)
+		obj := newMemcached("example")
+		timeInfo.SetLastReconcile("default", "example")
+
+		registry.Predicate().Delete(event.DeleteEvent{Meta: obj, Object: obj, DeleteStateUnknown: true})
+
+		Expect(gatheredNames(registry)).To(BeEmpty())
+	})
+})
@@ -0,0 +1,73 @@
+/*
+Copyright 2020 The Operator-SDK Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Exemplar returns exemplar labels identifying the revision of obj that an
+// event or reconcile was about, or nil if obj is nil or has no UID.
+// Exemplars are only exposed to scrapers that negotiate OpenMetrics.
+func Exemplar(obj metav1.Object) prometheus.Labels {
+	if obj == nil || obj.GetUID() == "" {
+		return nil
+	}
+	labels := prometheus.Labels{
+		"uid":              string(obj.GetUID()),
+		"resource_version": obj.GetResourceVersion(),
+	}
+	if !validExemplar(labels) {
+		return nil
+	}
+	return labels
+}
+
+// validExemplar reports whether labels fit in an exemplar. The client
+// library panics on exemplars that do not.
+func validExemplar(labels prometheus.Labels) bool {
+	runes := 0
+	for name, value := range labels {
+		if !utf8.ValidString(value) {
+			return false
+		}
+		runes += utf8.RuneCountInString(name) + utf8.RuneCountInString(value)
+	}
+	return runes <= prometheus.ExemplarMaxRunes
+}
+
+// ObserveWithExemplar observes v, attaching exemplar if it is not nil and o
+// supports exemplars.
+func ObserveWithExemplar(o prometheus.Observer, v float64, exemplar prometheus.Labels) {
+	if eo, ok := o.(prometheus.ExemplarObserver); ok && exemplar != nil {
+		eo.ObserveWithExemplar(v, exemplar)
+		return
+	}
+	o.Observe(v)
+}
+
+// AddWithExemplar adds v to c, attaching exemplar if it is not nil.
+func AddWithExemplar(c prometheus.Counter, v float64, exemplar prometheus.Labels) {
+	if ea, ok := c.(prometheus.ExemplarAdder); ok && exemplar != nil {
+		ea.AddWithExemplar(v, exemplar)
+		return
+	}
+	c.Add(v)
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2020 The Operator-SDK Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// CreateEventFilter is implemented by collectors that decide whether a create
+// event is passed on to the controller.
+type CreateEventFilter interface {
+	FilterCreate(e event.CreateEvent) bool
+}
+
+// UpdateEventFilter is implemented by collectors that decide whether an
+// update event is passed on to the controller.
+type UpdateEventFilter interface {
+	FilterUpdate(e event.UpdateEvent) bool
+}
+
+// DeleteEventFilter is implemented by collectors that decide whether a delete
+// event is passed on to the controller.
+type DeleteEventFilter interface {
+	FilterDelete(e event.DeleteEvent) bool
+}
+
+// GenericEventFilter is implemented by collectors that decide whether a
+// generic event is passed on to the controller.
+type GenericEventFilter interface {
+	FilterGeneric(e event.GenericEvent) bool
+}
+
+// FilterMode selects how the verdicts of several filters are combined.
+type FilterMode int
+
+const (
+	// MatchAll passes an event only if every filter accepts it.
+	MatchAll FilterMode = iota
+	// MatchAny passes an event if at least one filter accepts it.
+	MatchAny
+)
+
+// combine evaluates every verdict and combines them according to the mode.
+// An event with no filters is always passed.
+func (m FilterMode) combine(n int, verdict func(i int) bool) bool {
+	if n == 0 {
+		return true
+	}
+	all, any := true, false
+	for i := 0; i < n; i++ {
+		if verdict(i) {
+			any = true
+		} else {
+			all = false
+		}
+	}
+	if m == MatchAny {
+		return any
+	}
+	return all
+}
+
+// FilterPredicate returns a predicate that, like Predicate, passes every event
+// to the registered event handlers, but only lets the event through to the
+// controller if the registered filters accept it. Use it in place of
+// Predicate, not alongside it, or handlers will see each event twice.
+func (r *Registry) FilterPredicate(mode FilterMode) predicate.Predicate {
+	return predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool {
+			h := r.loadHandlers()
+			r.dispatchCreate(h, e)
+			return mode.combine(len(h.createFilters), func(i int) bool {
+				f := h.createFilters[i]
+				return r.filter(f.name, createEvent, e.Meta, func() bool {
+					return f.collector.(CreateEventFilter).FilterCreate(e)
+				})
+			})
+		},
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			h := r.loadHandlers()
+			r.dispatchUpdate(h, e)
+			return mode.combine(len(h.updateFilters), func(i int) bool {
+				f := h.updateFilters[i]
+				return r.filter(f.name, updateEvent, e.MetaNew, func() bool {
+					return f.collector.(UpdateEventFilter).FilterUpdate(e)
+				})
+			})
+		},
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			h := r.loadHandlers()
+			r.dispatchDelete(h, e)
+			return mode.combine(len(h.deleteFilters), func(i int) bool {
+				f := h.deleteFilters[i]
+				return r.filter(f.name, deleteEvent, e.Meta, func() bool {
+					return f.collector.(DeleteEventFilter).FilterDelete(e)
+				})
+			})
+		},
+		GenericFunc: func(e event.GenericEvent) bool {
+			h := r.loadHandlers()
+			r.dispatchGeneric(h, e)
+			return mode.combine(len(h.genericFilters), func(i int) bool {
+				f := h.genericFilters[i]
+				return r.filter(f.name, genericEvent, e.Meta, func() bool {
+					return f.collector.(GenericEventFilter).FilterGeneric(e)
+				})
+			})
+		},
+	}
+}
+
+// filter runs a single filter through instrument. A filter that panics
+// accepts the event, so a broken collector cannot stall reconciliation.
+func (r *Registry) filter(collector, eventType string, obj metav1.Object, fn func() bool) bool {
+	accept := true
+	r.instrument(collector, eventType, obj, func() { accept = fn() })
+	return accept
+}
@@ -0,0 +1,504 @@
+/*
+Copyright 2020 The Operator-SDK Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+// MetricType is the kind of metric a FamilyConfig generates.
+type MetricType string
+
+const (
+	// MetricTypeGauge exposes the value found at the family's value path.
+	MetricTypeGauge MetricType = "gauge"
+	// MetricTypeInfo always exposes 1 and carries its information in labels.
+	MetricTypeInfo MetricType = "info"
+)
+
+// LabelConfig maps a Prometheus label to a path into the object.
+type LabelConfig struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+// GroupVersionKind selects the kind of object a family is generated from.
+type GroupVersionKind struct {
+	Group   string `json:"group"`
+	Version string `json:"version"`
+	Kind    string `json:"kind"`
+}
+
+// FamilyConfig declaratively describes a metric family derived from the
+// fields of a custom resource.
+//
+// Paths use a dotted field syntax rooted at the object, e.g. ".spec.size" or
+// ".metadata.labels.app". Keys containing dots are written in brackets, as
+// in .metadata.labels["app.kubernetes.io/name"]. A path may be followed by a
+// pipe to a function:
+// ".status.nodes | len" counts a list or map, and
+// ".metadata.creationTimestamp | unix" converts an RFC3339 timestamp to unix
+// seconds.
+//
+// When GroupVersionKind is set, events for objects of any other kind are
+// ignored.
+//
+// Objects whose labels evaluate to the same values share one series. It
+// lives until the last of them is deleted or relabelled, and holds the value
+// of the object observed last, so gauges should be labelled by namespace
+// and name.
+type FamilyConfig struct {
+	Name             string            `json:"name"`
+	Help             string            `json:"help"`
+	Type             MetricType        `json:"type"`
+	GroupVersionKind *GroupVersionKind `json:"groupVersionKind,omitempty"`
+	Labels           []LabelConfig     `json:"labels,omitempty"`
+	Value            string            `json:"value,omitempty"`
+}
+
+// FamilyCollector is a collector built from a FamilyConfig. It implements
+// the Create, Update and Delete event handlers for any runtime.Object and
+// keeps one series per object.
+type FamilyCollector struct {
+	*prometheus.GaugeVec
+
+	config FamilyConfig
+	gvk    *schema.GroupVersionKind
+	scheme *runtime.Scheme
+	labels []*fieldPath
+	value  *fieldPath
+
+	mu     sync.Mutex
+	series map[string][]string
+	// refs counts the objects using each label set, keyed by seriesKey.
+	refs map[string]int
+}
+
+// NewFamilyCollector validates cfg and compiles its paths into a collector.
+func NewFamilyCollector(cfg FamilyConfig) (*FamilyCollector, error) {
+	if cfg.Name == "" {
+		return nil, fmt.Errorf("metric family name must not be empty")
+	}
+	if cfg.Help == "" {
+		cfg.Help = fmt.Sprintf("Generated metric %s", cfg.Name)
+	}
+
+	c := &FamilyCollector{
+		config: cfg,
+		series: map[string][]string{},
+		refs:   map[string]int{},
+	}
+
+	switch cfg.Type {
+	case MetricTypeInfo:
+		if cfg.Value != "" {
+			return nil, fmt.Errorf("metric family %q: info metrics do not take a value path", cfg.Name)
+		}
+	case MetricTypeGauge:
+		if cfg.Value == "" {
+			return nil, fmt.Errorf("metric family %q: gauge metrics require a value path", cfg.Name)
+		}
+		value, err := compilePath(cfg.Value)
+		if err != nil {
+			return nil, fmt.Errorf("metric family %q: value: %v", cfg.Name, err)
+		}
+		c.value = value
+	default:
+		return nil, fmt.Errorf("metric family %q: unsupported type %q", cfg.Name, cfg.Type)
+	}
+
+	if gvk := cfg.GroupVersionKind; gvk != nil {
+		if gvk.Version == "" || gvk.Kind == "" {
+			return nil, fmt.Errorf("metric family %q: groupVersionKind requires a version and kind", cfg.Name)
+		}
+		c.gvk = &schema.GroupVersionKind{Group: gvk.Group, Version: gvk.Version, Kind: gvk.Kind}
+	}
+
+	labelNames := make([]string, 0, len(cfg.Labels))
+	for _, l := range cfg.Labels {
+		p, err := compilePath(l.Path)
+		if err != nil {
+			return nil, fmt.Errorf("metric family %q: label %q: %v", cfg.Name, l.Name, err)
+		}
+		labelNames = append(labelNames, l.Name)
+		c.labels = append(c.labels, p)
+	}
+
+	c.GaugeVec = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: cfg.Name,
+		Help: cfg.Help,
+	}, labelNames)
+	return c, nil
+}
+
+// Config returns the configuration the collector was built from.
+func (c *FamilyCollector) Config() FamilyConfig {
+	return c.config
+}
+
+func (c *FamilyCollector) Create(e event.CreateEvent) {
+	if !c.matches(e.Object) {
+		return
+	}
+	c.observe(objectKey(e.Meta.GetNamespace(), e.Meta.GetName()), e.Object)
+}
+
+func (c *FamilyCollector) Update(e event.UpdateEvent) {
+	if !c.matches(e.ObjectNew) {
+		return
+	}
+	c.observe(objectKey(e.MetaNew.GetNamespace(), e.MetaNew.GetName()), e.ObjectNew)
+}
+
+func (c *FamilyCollector) Delete(e event.DeleteEvent) {
+	if !c.matches(e.Object) {
+		return
+	}
+	c.forget(objectKey(e.Meta.GetNamespace(), e.Meta.GetName()))
+}
+
+// ResyncKinds implements KindedResyncHandler. A family without a
+// groupVersionKind matches every kind and reports none.
+func (c *FamilyCollector) ResyncKinds() []schema.GroupVersionKind {
+	if c.gvk == nil {
+		return nil
+	}
+	return []schema.GroupVersionKind{*c.gvk}
+}
+
+// Resync recomputes the series of every matching object and deletes the
+// series of objects that no longer exist.
+func (c *FamilyCollector) Resync(objs []runtime.Object) {
+	seen := map[string]bool{}
+	for _, obj := range objs {
+		if !c.matches(obj) {
+			continue
+		}
+		m, err := meta.Accessor(obj)
+		if err != nil {
+			continue
+		}
+		key := objectKey(m.GetNamespace(), m.GetName())
+		seen[key] = true
+		c.observe(key, obj)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.series {
+		if !seen[key] {
+			c.release(key)
+		}
+	}
+}
+
+// matches reports whether obj is of the kind the family is generated from.
+// Objects read from the cache usually carry no TypeMeta, so the kind is
+// resolved through the scheme when one is available.
+func (c *FamilyCollector) matches(obj runtime.Object) bool {
+	if c.gvk == nil {
+		return true
+	}
+	if obj == nil {
+		return false
+	}
+	gvk := obj.GetObjectKind().GroupVersionKind()
+	if gvk.Empty() && c.scheme != nil {
+		var err error
+		if gvk, err = apiutil.GVKForObject(obj, c.scheme); err != nil {
+			return false
+		}
+	}
+	return gvk == *c.gvk
+}
+
+// observe recomputes the series for the object stored under key, replacing
+// the previous series if its label values changed.
+func (c *FamilyCollector) observe(key string, obj runtime.Object) {
+	content, err := toUnstructured(obj)
+	if err != nil {
+		RecordError(c.config.Name, err, "object", key)
+		return
+	}
+
+	labelValues := make([]string, len(c.labels))
+	for i, p := range c.labels {
+		v, _, err := p.evaluate(content)
+		if err != nil {
+			RecordError(c.config.Name, err, "object", key, "label", c.config.Labels[i].Name)
+			return
+		}
+		labelValues[i] = labelString(v)
+	}
+
+	value := float64(1)
+	if c.value != nil {
+		v, found, err := c.value.evaluate(content)
+		if err != nil {
+			RecordError(c.config.Name, err, "object", key)
+			return
+		}
+		if !found {
+			// Nothing to report; drop any series left from a previous event.
+			c.forget(key)
+			return
+		}
+		if value, err = toFloat64(v); err != nil {
+			RecordError(c.config.Name, err, "object", key)
+			return
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m, err := c.GaugeVec.GetMetricWithLabelValues(labelValues...)
+	if err != nil {
+		RecordError(c.config.Name, err, "object", key)
+		return
+	}
+	m.Set(value)
+	if old, ok := c.series[key]; ok {
+		if equalStrings(old, labelValues) {
+			return
+		}
+		c.release(key)
+	}
+	c.series[key] = labelValues
+	c.refs[seriesKey(labelValues)]++
+}
+
+// forget removes the object stored under key from its series.
+func (c *FamilyCollector) forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.release(key)
+}
+
+// release drops the reference of the object stored under key to its label
+// set, deleting the series once no object uses it. It must be called with
+// c.mu held.
+func (c *FamilyCollector) release(key string) {
+	old, ok := c.series[key]
+	if !ok {
+		return
+	}
+	delete(c.series, key)
+	sk := seriesKey(old)
+	if c.refs[sk]--; c.refs[sk] > 0 {
+		return
+	}
+	delete(c.refs, sk)
+	c.GaugeVec.DeleteLabelValues(old...)
+}
+
+// seriesKey joins label values with a byte that cannot occur in valid UTF-8.
+func seriesKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+func objectKey(namespace, name string) string {
+	return types.NamespacedName{Namespace: namespace, Name: name}.String()
+}
+
+func toUnstructured(obj runtime.Object) (map[string]interface{}, error) {
+	if obj == nil {
+		return nil, fmt.Errorf("event carries no object")
+	}
+	if u, ok := obj.(runtime.Unstructured); ok {
+		return u.UnstructuredContent(), nil
+	}
+	return runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+}
+
+// fieldPath is a compiled path expression.
+type fieldPath struct {
+	expr   string
+	fields []string
+	fn     string
+}
+
+var pathFuncs = map[string]bool{
+	"len":  true,
+	"unix": true,
+}
+
+func compilePath(expr string) (*fieldPath, error) {
+	s := strings.TrimSpace(expr)
+	if !strings.HasPrefix(s, ".") {
+		return nil, fmt.Errorf("path %q: must start with '.'", expr)
+	}
+	p := &fieldPath{expr: expr}
+	i := 0
+	if len(s) == 1 || isPathEnd(s[1]) {
+		// The root object itself.
+		i = 1
+	}
+	for i < len(s) && !isPathEnd(s[i]) {
+		switch {
+		case strings.HasPrefix(s[i:], ".["):
+			// A bracketed key may follow a dot, as in .["a.b"].
+			i++
+		case s[i] == '[':
+			if !strings.HasPrefix(s[i:], `["`) {
+				return nil, fmt.Errorf("path %q: expected a quoted key after '['", expr)
+			}
+			end := strings.Index(s[i+2:], `"]`)
+			if end < 0 {
+				return nil, fmt.Errorf("path %q: unterminated key", expr)
+			}
+			p.fields = append(p.fields, s[i+2:i+2+end])
+			i += end + 4
+		case s[i] == '.':
+			j := i + 1
+			for j < len(s) && !isPathEnd(s[j]) && s[j] != '.' && s[j] != '[' {
+				j++
+			}
+			if j == i+1 {
+				return nil, fmt.Errorf("path %q: empty field name", expr)
+			}
+			p.fields = append(p.fields, s[i+1:j])
+			i = j
+		default:
+			return nil, fmt.Errorf("path %q: unexpected %q", expr, s[i])
+		}
+	}
+
+	rest := strings.TrimSpace(s[i:])
+	if rest == "" {
+		return p, nil
+	}
+	if rest[0] != '|' {
+		return nil, fmt.Errorf("path %q: unexpected %q", expr, rest)
+	}
+	p.fn = strings.TrimSpace(rest[1:])
+	if strings.Contains(p.fn, "|") {
+		return nil, fmt.Errorf("path %q: only one function may be applied", expr)
+	}
+	if !pathFuncs[p.fn] {
+		return nil, fmt.Errorf("path %q: unknown function %q", expr, p.fn)
+	}
+	return p, nil
+}
+
+func isPathEnd(b byte) bool {
+	return b == '|' || b == ' ' || b == '\t'
+}
+
+// evaluate resolves the path against content. It reports whether the field
+// was present; missing fields are not an error.
+func (p *fieldPath) evaluate(content map[string]interface{}) (interface{}, bool, error) {
+	var cur interface{} = content
+	for _, f := range p.fields {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			if cur == nil {
+				return nil, false, nil
+			}
+			return nil, false, fmt.Errorf("path %q: field %q is not an object", p.expr, f)
+		}
+		if cur, ok = m[f]; !ok {
+			return nil, false, nil
+		}
+	}
+
+	switch p.fn {
+	case "len":
+		switch v := cur.(type) {
+		case nil:
+			return int64(0), true, nil
+		case []interface{}:
+			return int64(len(v)), true, nil
+		case map[string]interface{}:
+			return int64(len(v)), true, nil
+		case string:
+			return int64(len(v)), true, nil
+		default:
+			return nil, false, fmt.Errorf("path %q: cannot take len of %T", p.expr, cur)
+		}
+	case "unix":
+		if cur == nil {
+			return nil, false, nil
+		}
+		s, ok := cur.(string)
+		if !ok {
+			return nil, false, fmt.Errorf("path %q: expected a timestamp, got %T", p.expr, cur)
+		}
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return nil, false, fmt.Errorf("path %q: %v", p.expr, err)
+		}
+		return t.Unix(), true, nil
+	}
+	return cur, cur != nil, nil
+}
+
+func labelString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func toFloat64(v interface{}) (float64, error) {
+	switch v := v.(type) {
+	case int64:
+		return float64(v), nil
+	case int32:
+		return float64(v), nil
+	case int:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	case string:
+		return strconv.ParseFloat(v, 64)
+	default:
+		return 0, fmt.Errorf("cannot convert %T to a metric value", v)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
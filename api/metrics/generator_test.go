@@ -0,0 +1,210 @@
+/*
+Copyright 2020 The Operator-SDK Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	cachev1alpha1 "github.com/bharathi-tenneti/memcached-operator-metrics/api/v1alpha1"
+)
+
+var _ = Describe("compilePath", func() {
+	It("splits dotted and bracketed fields", func() {
+		for expr, fields := range map[string][]string{
+			".":          nil,
+			".spec.size": {"spec", "size"},
+			`.metadata.labels["app.kubernetes.io/name"]`: {"metadata", "labels", "app.kubernetes.io/name"},
+			`.metadata.labels.["team.io/owner"]`:         {"metadata", "labels", "team.io/owner"},
+			`.["a.b"].c`:                                 {"a.b", "c"},
+		} {
+			p, err := compilePath(expr)
+			Expect(err).NotTo(HaveOccurred(), expr)
+			Expect(p.fields).To(Equal(fields), expr)
+		}
+	})
+
+	It("parses a trailing function", func() {
+		p, err := compilePath(`.metadata.labels["a.b"] | len`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(p.fields).To(Equal([]string{"metadata", "labels", "a.b"}))
+		Expect(p.fn).To(Equal("len"))
+	})
+
+	It("rejects malformed paths", func() {
+		for _, expr := range []string{
+			"spec.size",
+			".spec..size",
+			`.metadata.labels["a.b"`,
+			`.metadata.labels[a]`,
+			".spec.size | len | unix",
+			".spec.size | sum",
+			".spec.size extra",
+		} {
+			_, err := compilePath(expr)
+			Expect(err).To(HaveOccurred(), expr)
+		}
+	})
+})
+
+var _ = Describe("FamilyCollector", func() {
+	var registry RegistererGathererPredicater
+
+	BeforeEach(func() {
+		registry = NewRegistry()
+	})
+
+	register := func(cfg FamilyConfig) *FamilyCollector {
+		c, err := NewFamilyCollector(cfg)
+		Expect(err).NotTo(HaveOccurred())
+		registry.MustRegister(c)
+		return c
+	}
+
+	nameLabel := []LabelConfig{{Name: "name", Path: ".metadata.name"}}
+
+	create := func(obj *cachev1alpha1.Memcached) {
+		registry.Predicate().Create(event.CreateEvent{Meta: obj, Object: obj})
+	}
+
+	It("counts lists with | len", func() {
+		register(FamilyConfig{Name: "nodes", Type: MetricTypeGauge, Labels: nameLabel, Value: ".status.nodes | len"})
+		obj := newMemcached("example")
+		obj.Status.Nodes = []string{"a", "b", "c"}
+		create(obj)
+
+		Expect(familySeries(registry, "nodes")).To(Equal(map[string]float64{"name=example": 3}))
+	})
+
+	It("converts timestamps with | unix", func() {
+		register(FamilyConfig{Name: "created", Type: MetricTypeGauge, Labels: nameLabel, Value: ".metadata.creationTimestamp | unix"})
+		obj := newMemcached("example")
+		created := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+		obj.CreationTimestamp = metav1.NewTime(created)
+		create(obj)
+
+		Expect(familySeries(registry, "created")).To(Equal(map[string]float64{"name=example": float64(created.Unix())}))
+	})
+
+	It("reads label keys containing dots", func() {
+		register(FamilyConfig{Name: "app_info", Type: MetricTypeInfo, Labels: []LabelConfig{
+			{Name: "name", Path: ".metadata.name"},
+			{Name: "app", Path: `.metadata.labels["app.kubernetes.io/name"]`},
+		}})
+		obj := newMemcached("example")
+		obj.Labels = map[string]string{"app.kubernetes.io/name": "cache"}
+		create(obj)
+
+		Expect(familySeries(registry, "app_info")).To(Equal(map[string]float64{"app=cache,name=example": 1}))
+	})
+
+	It("leaves out gauges whose value is missing and uses empty labels for missing fields", func() {
+		register(FamilyConfig{Name: "deleted", Type: MetricTypeGauge, Labels: nameLabel, Value: ".metadata.deletionTimestamp | unix"})
+		register(FamilyConfig{Name: "team_info", Type: MetricTypeInfo, Labels: []LabelConfig{
+			{Name: "name", Path: ".metadata.name"},
+			{Name: "team", Path: ".metadata.labels.team"},
+		}})
+		create(newMemcached("example"))
+
+		Expect(familySeries(registry, "deleted")).To(BeEmpty())
+		Expect(familySeries(registry, "team_info")).To(Equal(map[string]float64{"name=example,team=": 1}))
+	})
+
+	It("counts paths through non-object fields as errors", func() {
+		registry = NewDefaultRegistry()
+		register(FamilyConfig{Name: "bad", Type: MetricTypeGauge, Labels: nameLabel, Value: ".metadata.name.first"})
+		before := testutil.ToFloat64(metricsErrors.WithLabelValues("bad"))
+		create(newMemcached("example"))
+
+		Expect(familySeries(registry, "bad")).To(BeEmpty())
+		Expect(testutil.ToFloat64(metricsErrors.WithLabelValues("bad"))).To(Equal(before + 1))
+	})
+
+	It("replaces the series of an object whose labels change", func() {
+		register(FamilyConfig{Name: "team_info", Type: MetricTypeInfo, Labels: []LabelConfig{
+			{Name: "name", Path: ".metadata.name"},
+			{Name: "team", Path: ".metadata.labels.team"},
+		}})
+		obj := newMemcached("example")
+		obj.Labels = map[string]string{"team": "a"}
+		create(obj)
+		moved := obj.DeepCopy()
+		moved.Labels["team"] = "b"
+		registry.Predicate().Update(event.UpdateEvent{MetaOld: obj, ObjectOld: obj, MetaNew: moved, ObjectNew: moved})
+
+		Expect(familySeries(registry, "team_info")).To(Equal(map[string]float64{"name=example,team=b": 1}))
+	})
+
+	It("keeps a shared series until the last object using it is gone", func() {
+		register(FamilyConfig{Name: "team_info", Type: MetricTypeInfo, Labels: []LabelConfig{
+			{Name: "team", Path: ".metadata.labels.team"},
+		}})
+		first, second := newMemcached("first"), newMemcached("second")
+		first.Labels = map[string]string{"team": "a"}
+		second.Labels = map[string]string{"team": "a"}
+		create(first)
+		create(second)
+
+		moved := second.DeepCopy()
+		moved.Labels["team"] = "b"
+		registry.Predicate().Update(event.UpdateEvent{MetaOld: second, ObjectOld: second, MetaNew: moved, ObjectNew: moved})
+		Expect(familySeries(registry, "team_info")).To(Equal(map[string]float64{"team=a": 1, "team=b": 1}))
+
+		registry.Predicate().Delete(event.DeleteEvent{Meta: moved, Object: moved})
+		Expect(familySeries(registry, "team_info")).To(Equal(map[string]float64{"team=a": 1}))
+
+		registry.Resync(nil)
+		Expect(familySeries(registry, "team_info")).To(BeEmpty())
+	})
+
+	It("matches typed objects without TypeMeta through the scheme", func() {
+		scheme := runtime.NewScheme()
+		Expect(cachev1alpha1.AddToScheme(scheme)).To(Succeed())
+		cfg := &Config{Metrics: []FamilyConfig{{
+			Name:   "size",
+			Type:   MetricTypeGauge,
+			Labels: nameLabel,
+			Value:  ".spec.size",
+			GroupVersionKind: &GroupVersionKind{
+				Group: cachev1alpha1.GroupVersion.Group, Version: cachev1alpha1.GroupVersion.Version, Kind: "Memcached",
+			},
+		}}}
+		collectors, err := cfg.Collectors(scheme)
+		Expect(err).NotTo(HaveOccurred())
+		registry.MustRegister(collectors[0])
+
+		obj := newMemcached("typed")
+		obj.Spec.Size = 2
+		Expect(obj.Kind).To(BeEmpty())
+		create(obj)
+
+		other := &unstructured.Unstructured{}
+		other.SetGroupVersionKind(cachev1alpha1.GroupVersion.WithKind("Redis"))
+		other.SetNamespace("default")
+		other.SetName("other")
+		registry.Predicate().Create(event.CreateEvent{Meta: other, Object: other})
+
+		Expect(familySeries(registry, "size")).To(Equal(map[string]float64{"name=typed": 2}))
+	})
+})
@@ -0,0 +1,291 @@
+/*
+Copyright 2020 The Operator-SDK Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	cachev1alpha1 "github.com/bharathi-tenneti/memcached-operator-metrics/api/v1alpha1"
+)
+
+// memcachedLabels identify the object of every Memcached series.
+var memcachedLabels = []string{"namespace", "memcached"}
+
+// sample is one series of a family for a single object. Labels holds the
+// values of the family's extra labels, in order.
+type sample struct {
+	labels []string
+	value  float64
+}
+
+// memcachedFamily is a gauge family with one or more series per Memcached.
+type memcachedFamily struct {
+	vec      *prometheus.GaugeVec
+	generate func(m *cachev1alpha1.Memcached) []sample
+}
+
+// MemcachedCollectorOptions configures a MemcachedCollector.
+type MemcachedCollectorOptions struct {
+	// LabelsAllowlist and AnnotationsAllowlist are the label and annotation
+	// keys exposed by memcached_labels and memcached_annotations. All other
+	// keys are dropped to bound cardinality.
+	LabelsAllowlist      []string
+	AnnotationsAllowlist []string
+}
+
+// MemcachedCollector exposes kube-state-metrics style families for Memcached
+// resources. Objects of other kinds are ignored.
+type MemcachedCollector struct {
+	families []memcachedFamily
+
+	mu sync.Mutex
+	// series holds, per object key, the label values last set in each
+	// family, so changed or deleted series can be removed.
+	series map[string][][][]string
+}
+
+// NewMemcachedCollector returns a collector for the Memcached families.
+func NewMemcachedCollector(opts MemcachedCollectorOptions) *MemcachedCollector {
+	c := &MemcachedCollector{series: map[string][][][]string{}}
+	c.add("memcached_info", "Information about a Memcached.", []string{"uid"},
+		func(m *cachev1alpha1.Memcached) []sample {
+			return []sample{{labels: []string{string(m.UID)}, value: 1}}
+		})
+	c.add("memcached_created", "Unix creation timestamp of a Memcached.", nil,
+		func(m *cachev1alpha1.Memcached) []sample {
+			if m.CreationTimestamp.IsZero() {
+				return nil
+			}
+			return []sample{{value: float64(m.CreationTimestamp.Unix())}}
+		})
+	c.add("memcached_spec_size", "Desired number of memcached pods.", nil,
+		func(m *cachev1alpha1.Memcached) []sample {
+			return []sample{{value: float64(m.Spec.Size)}}
+		})
+	c.add("memcached_status_nodes", "Number of memcached pods reported in status.", nil,
+		func(m *cachev1alpha1.Memcached) []sample {
+			return []sample{{value: float64(len(m.Status.Nodes))}}
+		})
+	c.add("memcached_status_ready_replicas", "Number of ready memcached pods reported in status.", nil,
+		func(m *cachev1alpha1.Memcached) []sample {
+			return []sample{{value: float64(m.Status.ReadyReplicas)}}
+		})
+	c.add("memcached_deletion_timestamp", "Unix deletion timestamp of a Memcached being deleted.", nil,
+		func(m *cachev1alpha1.Memcached) []sample {
+			if m.DeletionTimestamp == nil {
+				return nil
+			}
+			return []sample{{value: float64(m.DeletionTimestamp.Unix())}}
+		})
+	c.add("memcached_generation", "Generation of the desired state of a Memcached.", nil,
+		func(m *cachev1alpha1.Memcached) []sample {
+			return []sample{{value: float64(m.Generation)}}
+		})
+	c.add("memcached_observed_generation", "Generation of the desired state observed by the operator.", nil,
+		func(m *cachev1alpha1.Memcached) []sample {
+			return []sample{{value: float64(m.Status.ObservedGeneration)}}
+		})
+	c.addKeys("memcached_labels", "Allowlisted Kubernetes labels of a Memcached.", "label_", opts.LabelsAllowlist,
+		func(m *cachev1alpha1.Memcached) map[string]string { return m.Labels })
+	c.addKeys("memcached_annotations", "Allowlisted Kubernetes annotations of a Memcached.", "annotation_", opts.AnnotationsAllowlist,
+		func(m *cachev1alpha1.Memcached) map[string]string { return m.Annotations })
+	c.add("memcached_owner", "Owners of a Memcached.", []string{"owner_kind", "owner_name", "owner_is_controller"},
+		func(m *cachev1alpha1.Memcached) []sample {
+			if len(m.OwnerReferences) == 0 {
+				return []sample{{labels: []string{"<none>", "<none>", "<none>"}, value: 1}}
+			}
+			samples := make([]sample, 0, len(m.OwnerReferences))
+			for _, ref := range m.OwnerReferences {
+				isController := ref.Controller != nil && *ref.Controller
+				samples = append(samples, sample{
+					labels: []string{ref.Kind, ref.Name, strconv.FormatBool(isController)},
+					value:  1,
+				})
+			}
+			return samples
+		})
+	return c
+}
+
+// addKeys adds a family exposing the allowlisted keys of a string map as
+// labels, named as described by allowedLabels. Missing keys have empty
+// values.
+func (c *MemcachedCollector) addKeys(name, help, prefix string, allowlist []string,
+	get func(*cachev1alpha1.Memcached) map[string]string) {
+	keys, labels := allowedLabels(prefix, allowlist)
+	c.add(name, help, labels, func(m *cachev1alpha1.Memcached) []sample {
+		values := make([]string, len(keys))
+		for i, k := range keys {
+			values[i] = get(m)[k]
+		}
+		return []sample{{labels: values, value: 1}}
+	})
+}
+
+func (c *MemcachedCollector) add(name, help string, labels []string, generate func(*cachev1alpha1.Memcached) []sample) {
+	c.families = append(c.families, memcachedFamily{
+		vec: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: name,
+			Help: help,
+		}, append(append([]string{}, memcachedLabels...), labels...)),
+		generate: generate,
+	})
+}
+
+// Describe implements prometheus.Collector.
+func (c *MemcachedCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, f := range c.families {
+		f.vec.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (c *MemcachedCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, f := range c.families {
+		f.vec.Collect(ch)
+	}
+}
+
+func (c *MemcachedCollector) Create(e event.CreateEvent) {
+	if m, ok := toMemcached(e.Object); ok {
+		c.observe(m)
+	}
+}
+
+func (c *MemcachedCollector) Update(e event.UpdateEvent) {
+	if m, ok := toMemcached(e.ObjectNew); ok {
+		c.observe(m)
+	}
+}
+
+func (c *MemcachedCollector) Delete(e event.DeleteEvent) {
+	if _, ok := toMemcached(e.Object); ok {
+		c.forget(objectKey(e.Meta.GetNamespace(), e.Meta.GetName()))
+	}
+}
+
+// ResyncKinds implements KindedResyncHandler.
+func (c *MemcachedCollector) ResyncKinds() []schema.GroupVersionKind {
+	return []schema.GroupVersionKind{memcachedGVK}
+}
+
+// Resync sets the series of every Memcached in objs and deletes those of
+// all others.
+func (c *MemcachedCollector) Resync(objs []runtime.Object) {
+	seen := map[string]bool{}
+	for _, obj := range objs {
+		if m, ok := toMemcached(obj); ok {
+			seen[objectKey(m.Namespace, m.Name)] = true
+			c.observe(m)
+		}
+	}
+	c.mu.Lock()
+	var stale []string
+	for key := range c.series {
+		if !seen[key] {
+			stale = append(stale, key)
+		}
+	}
+	c.mu.Unlock()
+	for _, key := range stale {
+		c.forget(key)
+	}
+}
+
+// observe sets the series of every family for m, deleting the series it no
+// longer has.
+func (c *MemcachedCollector) observe(m *cachev1alpha1.Memcached) {
+	key := objectKey(m.Namespace, m.Name)
+	identity := []string{m.Namespace, m.Name}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	prev := c.series[key]
+	next := make([][][]string, len(c.families))
+	for i, f := range c.families {
+		for _, s := range f.generate(m) {
+			values := append(append([]string{}, identity...), s.labels...)
+			g, err := f.vec.GetMetricWithLabelValues(values...)
+			if err != nil {
+				RecordError("memcached", err, "namespace", m.Namespace, "name", m.Name)
+				continue
+			}
+			g.Set(s.value)
+			next[i] = append(next[i], values)
+		}
+		if i < len(prev) {
+			for _, old := range prev[i] {
+				if !containsValues(next[i], old) {
+					f.vec.DeleteLabelValues(old...)
+				}
+			}
+		}
+	}
+	c.series[key] = next
+}
+
+// forget deletes every series of the object with key.
+func (c *MemcachedCollector) forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, values := range c.series[key] {
+		for _, v := range values {
+			c.families[i].vec.DeleteLabelValues(v...)
+		}
+	}
+	delete(c.series, key)
+}
+
+func containsValues(set [][]string, values []string) bool {
+	for _, v := range set {
+		if equalStrings(v, values) {
+			return true
+		}
+	}
+	return false
+}
+
+// toMemcached returns obj as a Memcached, converting it if it was read as
+// unstructured. It reports false for objects of any other kind.
+// memcachedGVK is the kind of the objects toMemcached accepts.
+var memcachedGVK = cachev1alpha1.GroupVersion.WithKind("Memcached")
+
+func toMemcached(obj runtime.Object) (*cachev1alpha1.Memcached, bool) {
+	switch o := obj.(type) {
+	case *cachev1alpha1.Memcached:
+		return o, true
+	case *unstructured.Unstructured:
+		if o.GroupVersionKind() != memcachedGVK {
+			return nil, false
+		}
+		m := &cachev1alpha1.Memcached{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(o.Object, m); err != nil {
+			RecordError("memcached", err, "namespace", o.GetNamespace(), "name", o.GetName())
+			return nil, false
+		}
+		return m, true
+	default:
+		return nil, false
+	}
+}
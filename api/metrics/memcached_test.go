@@ -0,0 +1,205 @@
+/*
+Copyright 2020 The Operator-SDK Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	cachev1alpha1 "github.com/bharathi-tenneti/memcached-operator-metrics/api/v1alpha1"
+)
+
+// familySeries returns the value of every series of the named family,
+// keyed by its name=value labels joined with commas.
+func familySeries(g prometheus.Gatherer, name string) map[string]float64 {
+	series := map[string]float64{}
+	mf := gatheredFamily(g, name)
+	if mf == nil {
+		return series
+	}
+	for _, m := range mf.GetMetric() {
+		key := ""
+		for i, l := range m.GetLabel() {
+			if i > 0 {
+				key += ","
+			}
+			key += l.GetName() + "=" + l.GetValue()
+		}
+		series[key] = m.GetGauge().GetValue()
+	}
+	return series
+}
+
+var _ = Describe("MemcachedCollector", func() {
+	var (
+		registry RegistererGathererPredicater
+		pred     predicate.Predicate
+		obj      *cachev1alpha1.Memcached
+		created  = time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	)
+
+	BeforeEach(func() {
+		registry = NewRegistry()
+		registry.MustRegister(NewMemcachedCollector(MemcachedCollectorOptions{}))
+		pred = registry.Predicate()
+		obj = newMemcached("example")
+		obj.UID = types.UID("uid-1")
+		obj.CreationTimestamp = metav1.NewTime(created)
+	})
+
+	It("exposes the creation timestamp as a value and identity as labels", func() {
+		pred.Create(event.CreateEvent{Meta: obj, Object: obj})
+
+		Expect(familySeries(registry, "memcached_info")).To(Equal(map[string]float64{
+			"memcached=example,namespace=default,uid=uid-1": 1,
+		}))
+		Expect(familySeries(registry, "memcached_created")).To(Equal(map[string]float64{
+			"memcached=example,namespace=default": float64(created.Unix()),
+		}))
+	})
+
+	It("replaces the series of an object recreated under the same name", func() {
+		pred.Create(event.CreateEvent{Meta: obj, Object: obj})
+		recreated := obj.DeepCopy()
+		recreated.UID = types.UID("uid-2")
+		pred.Update(event.UpdateEvent{MetaOld: obj, ObjectOld: obj, MetaNew: recreated, ObjectNew: recreated})
+
+		Expect(familySeries(registry, "memcached_info")).To(Equal(map[string]float64{
+			"memcached=example,namespace=default,uid=uid-2": 1,
+		}))
+	})
+
+	It("deletes every series of a deleted object", func() {
+		pred.Create(event.CreateEvent{Meta: obj, Object: obj})
+		pred.Delete(event.DeleteEvent{Meta: obj, Object: obj})
+
+		Expect(familySeries(registry, "memcached_info")).To(BeEmpty())
+		Expect(familySeries(registry, "memcached_created")).To(BeEmpty())
+	})
+
+	It("converts unstructured Memcacheds and ignores other kinds", func() {
+		content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+		Expect(err).NotTo(HaveOccurred())
+		u := &unstructured.Unstructured{Object: content}
+		u.SetGroupVersionKind(cachev1alpha1.GroupVersion.WithKind("Memcached"))
+		pred.Create(event.CreateEvent{Meta: u, Object: u})
+
+		other := &unstructured.Unstructured{}
+		other.SetGroupVersionKind(cachev1alpha1.GroupVersion.WithKind("Redis"))
+		other.SetNamespace("default")
+		other.SetName("cache")
+		pred.Create(event.CreateEvent{Meta: other, Object: other})
+
+		Expect(familySeries(registry, "memcached_info")).To(Equal(map[string]float64{
+			"memcached=example,namespace=default,uid=uid-1": 1,
+		}))
+	})
+
+	It("exposes the spec, status and generations", func() {
+		obj.Generation = 3
+		obj.Spec.Size = 4
+		obj.Status = cachev1alpha1.MemcachedStatus{
+			Nodes:              []string{"a", "b"},
+			ReadyReplicas:      1,
+			ObservedGeneration: 2,
+		}
+		pred.Create(event.CreateEvent{Meta: obj, Object: obj})
+
+		id := "memcached=example,namespace=default"
+		for name, value := range map[string]float64{
+			"memcached_spec_size":             4,
+			"memcached_status_nodes":          2,
+			"memcached_status_ready_replicas": 1,
+			"memcached_generation":            3,
+			"memcached_observed_generation":   2,
+		} {
+			Expect(familySeries(registry, name)).To(Equal(map[string]float64{id: value}), name)
+		}
+		Expect(familySeries(registry, "memcached_deletion_timestamp")).To(BeEmpty())
+	})
+
+	It("exposes the deletion timestamp once deletion starts", func() {
+		pred.Create(event.CreateEvent{Meta: obj, Object: obj})
+		deleting := obj.DeepCopy()
+		deleted := metav1.NewTime(created.Add(time.Hour))
+		deleting.DeletionTimestamp = &deleted
+		pred.Update(event.UpdateEvent{MetaOld: obj, ObjectOld: obj, MetaNew: deleting, ObjectNew: deleting})
+
+		Expect(familySeries(registry, "memcached_deletion_timestamp")).To(Equal(map[string]float64{
+			"memcached=example,namespace=default": float64(deleted.Unix()),
+		}))
+	})
+
+	It("exposes only allowlisted labels and annotations", func() {
+		registry = NewRegistry()
+		registry.MustRegister(NewMemcachedCollector(MemcachedCollectorOptions{
+			LabelsAllowlist:      []string{"team", "app.kubernetes.io/name"},
+			AnnotationsAllowlist: []string{"owner"},
+		}))
+		obj.Labels = map[string]string{"team": "cache", "app.kubernetes.io/name": "memcached", "pod-template-hash": "x"}
+		obj.Annotations = map[string]string{"note": "ignored"}
+		registry.Predicate().Create(event.CreateEvent{Meta: obj, Object: obj})
+
+		Expect(familySeries(registry, "memcached_labels")).To(Equal(map[string]float64{
+			"label_app_kubernetes_io_name=memcached,label_team=cache,memcached=example,namespace=default": 1,
+		}))
+		Expect(familySeries(registry, "memcached_annotations")).To(Equal(map[string]float64{
+			"annotation_owner=,memcached=example,namespace=default": 1,
+		}))
+	})
+
+	It("exposes one series per owner", func() {
+		pred.Create(event.CreateEvent{Meta: obj, Object: obj})
+		Expect(familySeries(registry, "memcached_owner")).To(Equal(map[string]float64{
+			"memcached=example,namespace=default,owner_is_controller=<none>,owner_kind=<none>,owner_name=<none>": 1,
+		}))
+
+		owned := obj.DeepCopy()
+		isController := true
+		owned.OwnerReferences = []metav1.OwnerReference{
+			{Kind: "CacheSet", Name: "set", Controller: &isController},
+			{Kind: "Team", Name: "cache"},
+		}
+		pred.Update(event.UpdateEvent{MetaOld: obj, ObjectOld: obj, MetaNew: owned, ObjectNew: owned})
+		Expect(familySeries(registry, "memcached_owner")).To(Equal(map[string]float64{
+			"memcached=example,namespace=default,owner_is_controller=true,owner_kind=CacheSet,owner_name=set": 1,
+			"memcached=example,namespace=default,owner_is_controller=false,owner_kind=Team,owner_name=cache":  1,
+		}))
+	})
+
+	It("removes the series of objects missing from a resync", func() {
+		gone := newMemcached("gone")
+		pred.Create(event.CreateEvent{Meta: obj, Object: obj})
+		pred.Create(event.CreateEvent{Meta: gone, Object: gone})
+
+		registry.Resync([]runtime.Object{obj})
+
+		Expect(familySeries(registry, "memcached_info")).To(Equal(map[string]float64{
+			"memcached=example,namespace=default,uid=uid-1": 1,
+		}))
+		Expect(familySeries(registry, "memcached_created")).To(HaveLen(1))
+	})
+})
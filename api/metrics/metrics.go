@@ -18,11 +18,20 @@ package metrics
 
 import (
 	"context"
+	"crypto/tls"
+	"fmt"
 	"net"
 	"net/http"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"sigs.k8s.io/controller-runtime/pkg/event"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
@@ -52,24 +61,149 @@ type RegistererGathererPredicater interface {
 	prometheus.Registerer
 	prometheus.Gatherer
 	Predicate() predicate.Predicate
+	FilterPredicate(mode FilterMode) predicate.Predicate
+	Resync(objs []runtime.Object)
+	ResyncKinds(listed []schema.GroupVersionKind, objs []runtime.Object)
 }
 
+// Registry is a Prometheus registry that also dispatches the events seen by
+// its predicate to the registered collectors. Registration is serialized
+// while event dispatch reads an immutable snapshot of the handlers, so
+// collectors may be registered and unregistered while events are flowing.
+//
+// Every handler call is timed and recovered from panics, so a misbehaving
+// collector cannot take down the informer delivering the event.
 type Registry struct {
 	*prometheus.Registry
-	metrics []prometheus.Collector
+
+	mu       sync.Mutex
+	metrics  []registeredCollector
+	handlers atomic.Value // *handlerSet
+
+	handlerDuration *prometheus.HistogramVec
+	handlerFailures *createdCounterVec
+}
+
+type registeredCollector struct {
+	prometheus.Collector
+	name string
+}
+
+// handler is a registered collector as seen by event dispatch. The collector
+// is known to implement the interface of the slice it is stored in.
+type handler struct {
+	name      string
+	collector prometheus.Collector
 }
 
+// handlerSet holds the registered collectors grouped by the event handler
+// and filter interfaces they implement. It is never modified once published.
+type handlerSet struct {
+	create  []handler
+	update  []handler
+	delete  []handler
+	generic []handler
+	resync  []handler
+
+	createFilters  []handler
+	updateFilters  []handler
+	deleteFilters  []handler
+	genericFilters []handler
+}
+
+// Event types used as the "event" label of the handler metrics.
+const (
+	createEvent  = "create"
+	updateEvent  = "update"
+	deleteEvent  = "delete"
+	genericEvent = "generic"
+	resyncEvent  = "resync"
+)
+
+var eventTypes = []string{createEvent, updateEvent, deleteEvent, genericEvent, resyncEvent}
+
 func NewRegistry() RegistererGathererPredicater {
-	return &Registry{
+	r := &Registry{
 		Registry: prometheus.NewRegistry(),
+		handlerDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "metrics_handler_duration_seconds",
+			Help:    "Time spent by a metrics collector handling an event.",
+			Buckets: prometheus.ExponentialBuckets(0.00001, 4, 10),
+		}, []string{"collector", "event"}),
+		handlerFailures: newCreatedCounterVec(prometheus.CounterOpts{
+			Name: "metrics_handler_failures_total",
+			Help: "Number of panics recovered from a metrics collector handling an event.",
+		}, []string{"collector", "event"}),
+	}
+	// The handler metrics are not event handlers, so they bypass r.Register.
+	r.Registry.MustRegister(r.handlerDuration, r.handlerFailures)
+	return r
+}
+
+// instrument calls fn on behalf of the named collector, recording its
+// latency and recovering and counting any panic. It reports whether fn
+// returned normally. The recorded samples carry an exemplar identifying
+// obj, the object of the event, which may be nil.
+func (r *Registry) instrument(collector, eventType string, obj metav1.Object, fn func()) (ok bool) {
+	start := time.Now()
+	defer func() {
+		exemplar := Exemplar(obj)
+		if p := recover(); p != nil {
+			log.Error(fmt.Errorf("%v", p), "metrics collector panicked handling event",
+				"collector", collector, "event", eventType)
+			if r.handlerFailures != nil {
+				AddWithExemplar(r.handlerFailures.WithLabelValues(collector, eventType), 1, exemplar)
+			}
+			ok = false
+		}
+		if r.handlerDuration != nil {
+			ObserveWithExemplar(r.handlerDuration.WithLabelValues(collector, eventType),
+				time.Since(start).Seconds(), exemplar)
+		}
+	}()
+	fn()
+	return true
+}
+
+func (r *Registry) dispatchCreate(h *handlerSet, e event.CreateEvent) {
+	for _, m := range h.create {
+		c := m.collector.(CreateEventHandler)
+		r.instrument(m.name, createEvent, e.Meta, func() { c.Create(e) })
+	}
+}
+
+func (r *Registry) dispatchUpdate(h *handlerSet, e event.UpdateEvent) {
+	for _, m := range h.update {
+		c := m.collector.(UpdateEventHandler)
+		r.instrument(m.name, updateEvent, e.MetaNew, func() { c.Update(e) })
+	}
+}
+
+func (r *Registry) dispatchDelete(h *handlerSet, e event.DeleteEvent) {
+	for _, m := range h.delete {
+		c := m.collector.(DeleteEventHandler)
+		r.instrument(m.name, deleteEvent, e.Meta, func() { c.Delete(e) })
+	}
+}
+
+func (r *Registry) dispatchGeneric(h *handlerSet, e event.GenericEvent) {
+	for _, m := range h.generic {
+		c := m.collector.(GenericEventHandler)
+		r.instrument(m.name, genericEvent, e.Meta, func() { c.Generic(e) })
 	}
 }
 
 func (r *Registry) Register(c prometheus.Collector) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	if err := r.Registry.Register(c); err != nil {
 		return err
 	}
-	r.metrics = append(r.metrics, c)
+	r.metrics = append(r.metrics, registeredCollector{
+		Collector: c,
+		name:      collectorName(c),
+	})
+	r.publishHandlers()
 	return nil
 }
 
@@ -81,80 +215,262 @@ func (r *Registry) MustRegister(cs ...prometheus.Collector) {
 	}
 }
 
-func (r *Registry) Predicate() predicate.Predicate {
-	createHandlers := []CreateEventHandler{}
-	updateHandlers := []UpdateEventHandler{}
-	deleteHandlers := []DeleteEventHandler{}
-	genericHandlers := []GenericEventHandler{}
+// Unregister removes c from the Prometheus registry and stops dispatching
+// events to the collector it removed. Like the Prometheus registry,
+// collectors are matched by the names and constant labels they describe,
+// so an equivalent collector unregisters the original.
+func (r *Registry) Unregister(c prometheus.Collector) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.Registry.Unregister(c) {
+		return false
+	}
+	metrics := make([]registeredCollector, 0, len(r.metrics))
+	for _, m := range r.metrics {
+		if !sameCollector(m.Collector, c) {
+			metrics = append(metrics, m)
+			continue
+		}
+		if r.handlerDuration != nil {
+			for _, t := range eventTypes {
+				r.handlerDuration.DeleteLabelValues(m.name, t)
+				r.handlerFailures.DeleteLabelValues(m.name, t)
+			}
+		}
+	}
+	r.metrics = metrics
+	r.publishHandlers()
+	return true
+}
+
+// sameCollector reports whether the Prometheus registry takes a and b for
+// the same collector, that is whether unregistering b would remove a.
+func sameCollector(a, b prometheus.Collector) bool {
+	r := prometheus.NewRegistry()
+	return r.Register(a) == nil && r.Unregister(b)
+}
+
+var fqNamePattern = regexp.MustCompile(`fqName: "([^"]*)"`)
+
+// collectorName names a collector in the handler metrics after the first
+// metric it describes, falling back to its type.
+func collectorName(c prometheus.Collector) string {
+	descs := make(chan *prometheus.Desc)
+	go func() {
+		c.Describe(descs)
+		close(descs)
+	}()
+	name := ""
+	for d := range descs {
+		if m := fqNamePattern.FindStringSubmatch(d.String()); name == "" && m != nil {
+			name = m[1]
+		}
+	}
+	if name == "" {
+		name = fmt.Sprintf("%T", c)
+	}
+	return name
+}
 
+// publishHandlers builds a new handler snapshot from r.metrics. It must be
+// called with r.mu held.
+func (r *Registry) publishHandlers() {
+	h := &handlerSet{}
 	for _, m := range r.metrics {
-		if m, ok := m.(CreateEventHandler); ok {
-			createHandlers = append(createHandlers, m)
+		hd := handler{name: m.name, collector: m.Collector}
+		if _, ok := m.Collector.(CreateEventHandler); ok {
+			h.create = append(h.create, hd)
+		}
+		if _, ok := m.Collector.(UpdateEventHandler); ok {
+			h.update = append(h.update, hd)
+		}
+		if _, ok := m.Collector.(DeleteEventHandler); ok {
+			h.delete = append(h.delete, hd)
 		}
-		if m, ok := m.(UpdateEventHandler); ok {
-			updateHandlers = append(updateHandlers, m)
+		if _, ok := m.Collector.(GenericEventHandler); ok {
+			h.generic = append(h.generic, hd)
 		}
-		if m, ok := m.(DeleteEventHandler); ok {
-			deleteHandlers = append(deleteHandlers, m)
+		if _, ok := m.Collector.(ResyncHandler); ok {
+			h.resync = append(h.resync, hd)
 		}
-		if m, ok := m.(GenericEventHandler); ok {
-			genericHandlers = append(genericHandlers, m)
+		if _, ok := m.Collector.(CreateEventFilter); ok {
+			h.createFilters = append(h.createFilters, hd)
+		}
+		if _, ok := m.Collector.(UpdateEventFilter); ok {
+			h.updateFilters = append(h.updateFilters, hd)
+		}
+		if _, ok := m.Collector.(DeleteEventFilter); ok {
+			h.deleteFilters = append(h.deleteFilters, hd)
+		}
+		if _, ok := m.Collector.(GenericEventFilter); ok {
+			h.genericFilters = append(h.genericFilters, hd)
 		}
 	}
+	r.handlers.Store(h)
+}
 
+// loadHandlers returns the current handler snapshot.
+func (r *Registry) loadHandlers() *handlerSet {
+	if h, ok := r.handlers.Load().(*handlerSet); ok {
+		return h
+	}
+	return &handlerSet{}
+}
+
+// Predicate returns a predicate that passes every event to the collectors
+// registered at the time the event is received, so collectors registered or
+// unregistered after the predicate is built are taken into account. It never
+// filters events; see FilterPredicate.
+func (r *Registry) Predicate() predicate.Predicate {
 	return predicate.Funcs{
 		CreateFunc: func(e event.CreateEvent) bool {
-			for _, m := range createHandlers {
-				m.Create(e)
-			}
+			r.dispatchCreate(r.loadHandlers(), e)
 			return true
 		},
 		UpdateFunc: func(e event.UpdateEvent) bool {
-			for _, m := range updateHandlers {
-				m.Update(e)
-			}
+			r.dispatchUpdate(r.loadHandlers(), e)
 			return true
 		},
 		DeleteFunc: func(e event.DeleteEvent) bool {
-			for _, m := range deleteHandlers {
-				m.Delete(e)
-			}
+			r.dispatchDelete(r.loadHandlers(), e)
 			return true
 		},
 		GenericFunc: func(e event.GenericEvent) bool {
-			for _, m := range genericHandlers {
-				m.Generic(e)
-			}
+			r.dispatchGeneric(r.loadHandlers(), e)
 			return true
 		},
 	}
 }
 
+// Server serves the gathered metrics over HTTP, or HTTPS when a certificate
+// and key are configured.
 type Server struct {
 	Gatherer      prometheus.Gatherer
 	ListenAddress string
+	// AdditionalGatherers are served on the metrics path together with
+	// Gatherer, e.g. controller-runtime's registry, so a single scrape job
+	// covers both. Their families must not collide with Gatherer's.
+	AdditionalGatherers []prometheus.Gatherer
+
+	// CertFile and KeyFile hold the serving certificate and key. When set,
+	// the server serves HTTPS and reloads the pair when the files change.
+	CertFile string
+	KeyFile  string
+	// ClientCAFile, when set, requires clients to present a certificate
+	// signed by one of its CAs.
+	ClientCAFile string
+	// Authenticator, when set, authenticates and authorizes every request
+	// with the bearer token it carries. Health checks are not protected.
+	Authenticator *TokenAuthenticator
+	// Ready, when set, is checked by /readyz. A nil Ready is always ready.
+	Ready func() error
+
+	// ReadTimeout, WriteTimeout and IdleTimeout configure the underlying
+	// http.Server. They default to 10 seconds, 30 seconds and 2 minutes.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+	// ShutdownTimeout bounds how long in-flight requests are drained once
+	// stop is closed before their connections are closed forcibly. Defaults
+	// to 5 seconds.
+	ShutdownTimeout time.Duration
+	// MaxConcurrentScrapes limits concurrent requests to /metrics. Further
+	// requests are answered with 503. Zero means no limit.
+	MaxConcurrentScrapes int
 }
 
-const metricsPath = "/metrics"
+const (
+	metricsPath    = "/metrics"
+	healthzPath    = "/healthz"
+	readyzPath     = "/readyz"
+	collectorsPath = "/debug/collectors"
+
+	defaultReadTimeout     = 10 * time.Second
+	defaultWriteTimeout    = 30 * time.Second
+	defaultIdleTimeout     = 2 * time.Minute
+	defaultShutdownTimeout = 5 * time.Second
+)
+
+func durationOrDefault(d, def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return d
+}
+
+// NeedLeaderElection lets the server run on every replica, so health checks
+// answer while waiting for the leader lock.
+func (s *Server) NeedLeaderElection() bool {
+	return false
+}
+
+func (s *Server) readyz(w http.ResponseWriter, _ *http.Request) {
+	if s.Ready != nil {
+		if err := s.Ready(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	fmt.Fprintln(w, "ok")
+}
 
 func (s *Server) Start(stop <-chan struct{}) error {
-	log.Info("metrics server is starting to listen", "addr", s.ListenAddress)
+	tlsConfig, certs, err := s.tlsConfig()
+	if err != nil {
+		return err
+	}
+
+	log.Info("metrics server is starting to listen", "addr", s.ListenAddress, "tls", tlsConfig != nil)
 	l, err := net.Listen("tcp", s.ListenAddress)
 	if err != nil {
 		return err
 	}
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+		go certs.watch(stop, certReloadInterval)
+	}
 
-	handler := promhttp.HandlerFor(s.Gatherer, promhttp.HandlerOpts{
-		ErrorHandling: promhttp.HTTPErrorOnError,
-	})
+	protect := func(h http.Handler) http.Handler {
+		if s.Authenticator != nil {
+			return s.Authenticator.Wrap(h)
+		}
+		return h
+	}
+	gatherer := s.Gatherer
+	if len(s.AdditionalGatherers) > 0 {
+		gatherer = append(prometheus.Gatherers{s.Gatherer}, s.AdditionalGatherers...)
+	}
 	mux := http.NewServeMux()
-	mux.Handle(metricsPath, handler)
+	mux.Handle(metricsPath, protect(promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{
+		ErrorHandling:       promhttp.HTTPErrorOnError,
+		MaxRequestsInFlight: s.MaxConcurrentScrapes,
+		// Scrapers that accept OpenMetrics get it, including exemplars.
+		// Responses are gzipped when the scraper accepts it.
+		//
+		// The operator's own counters expose their creation times as
+		// separate _created gauges, see createdCounterVec.
+		EnableOpenMetrics: true,
+	})))
+	if l, ok := s.Gatherer.(collectorLister); ok {
+		mux.Handle(collectorsPath, protect(collectorsHandler(l)))
+	}
+	mux.HandleFunc(healthzPath, func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc(readyzPath, s.readyz)
 
+	readTimeout := durationOrDefault(s.ReadTimeout, defaultReadTimeout)
 	server := http.Server{
-		Handler: mux,
+		Handler:           mux,
+		ReadHeaderTimeout: readTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      durationOrDefault(s.WriteTimeout, defaultWriteTimeout),
+		IdleTimeout:       durationOrDefault(s.IdleTimeout, defaultIdleTimeout),
 	}
 
-	errChan := make(chan error)
+	// Buffered so the serving goroutine never blocks if it fails after
+	// Start has already returned.
+	errChan := make(chan error, 1)
 	go func() {
 		log.Info("starting metrics server", "path", metricsPath)
 		if err := server.Serve(l); err != nil && err != http.ErrServerClosed {
@@ -166,9 +482,16 @@ func (s *Server) Start(stop <-chan struct{}) error {
 	case err := <-errChan:
 		return err
 	case <-stop:
-		if err := server.Shutdown(context.Background()); err != nil {
-			return err
-		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		durationOrDefault(s.ShutdownTimeout, defaultShutdownTimeout))
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		// Requests still in flight at the deadline are cut off rather than
+		// holding up the manager's shutdown.
+		log.Info("metrics server did not drain in time, closing connections", "reason", err.Error())
+		return server.Close()
 	}
 	return nil
 }
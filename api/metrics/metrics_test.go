@@ -0,0 +1,453 @@
+/*
+Copyright 2020 The Operator-SDK Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	cachev1alpha1 "github.com/bharathi-tenneti/memcached-operator-metrics/api/v1alpha1"
+)
+
+// eventLog records which collectors received which events, in order.
+type eventLog struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (l *eventLog) add(s string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, s)
+}
+
+func (l *eventLog) get() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.events...)
+}
+
+// recordingCollector is a gauge that implements every event handler and
+// records the events it receives.
+type recordingCollector struct {
+	prometheus.Gauge
+	name string
+	log  *eventLog
+}
+
+func newRecordingCollector(name string, log *eventLog) *recordingCollector {
+	return &recordingCollector{
+		Gauge: prometheus.NewGauge(prometheus.GaugeOpts{Name: name, Help: name}),
+		name:  name,
+		log:   log,
+	}
+}
+
+func (c *recordingCollector) Create(event.CreateEvent)   { c.log.add(c.name + ":create") }
+func (c *recordingCollector) Update(event.UpdateEvent)   { c.log.add(c.name + ":update") }
+func (c *recordingCollector) Delete(event.DeleteEvent)   { c.log.add(c.name + ":delete") }
+func (c *recordingCollector) Generic(event.GenericEvent) { c.log.add(c.name + ":generic") }
+
+func newMemcached(name string) *cachev1alpha1.Memcached {
+	return &cachev1alpha1.Memcached{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+	}
+}
+
+// newConfigMap returns an object of another kind that shares the
+// namespace and name newMemcached would give it.
+func newConfigMap(name string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion("v1")
+	obj.SetKind("ConfigMap")
+	obj.SetNamespace("default")
+	obj.SetName(name)
+	return obj
+}
+
+// gatheredNames returns the names of the gathered families, leaving out the
+// registry's own handler metrics.
+func gatheredNames(g prometheus.Gatherer) []string {
+	mfs, err := g.Gather()
+	Expect(err).NotTo(HaveOccurred())
+	names := []string{}
+	for _, mf := range mfs {
+		if !strings.HasPrefix(mf.GetName(), "metrics_handler_") {
+			names = append(names, mf.GetName())
+		}
+	}
+	return names
+}
+
+// gatheredFamily returns the named family, or nil if it was not gathered.
+func gatheredFamily(g prometheus.Gatherer, name string) *dto.MetricFamily {
+	mfs, err := g.Gather()
+	Expect(err).NotTo(HaveOccurred())
+	for _, mf := range mfs {
+		if mf.GetName() == name {
+			return mf
+		}
+	}
+	return nil
+}
+
+var _ = Describe("Registry", func() {
+	var (
+		registry RegistererGathererPredicater
+		events   *eventLog
+		pred     predicate.Predicate
+		obj      *cachev1alpha1.Memcached
+	)
+
+	create := func() {
+		pred.Create(event.CreateEvent{Meta: obj, Object: obj})
+	}
+
+	BeforeEach(func() {
+		registry = NewRegistry()
+		events = &eventLog{}
+		pred = registry.Predicate()
+		obj = newMemcached("example")
+	})
+
+	It("dispatches every event type to registered handlers", func() {
+		registry.MustRegister(newRecordingCollector("a", events))
+
+		pred.Create(event.CreateEvent{Meta: obj, Object: obj})
+		pred.Update(event.UpdateEvent{MetaOld: obj, ObjectOld: obj, MetaNew: obj, ObjectNew: obj})
+		pred.Delete(event.DeleteEvent{Meta: obj, Object: obj})
+		pred.Generic(event.GenericEvent{Meta: obj, Object: obj})
+
+		Expect(events.get()).To(Equal([]string{"a:create", "a:update", "a:delete", "a:generic"}))
+	})
+
+	It("dispatches to collectors registered after the predicate was built", func() {
+		create()
+		Expect(events.get()).To(BeEmpty())
+
+		registry.MustRegister(newRecordingCollector("a", events))
+		create()
+		Expect(events.get()).To(Equal([]string{"a:create"}))
+	})
+
+	It("does not track a collector whose registration failed", func() {
+		registry.MustRegister(newRecordingCollector("a", events))
+		Expect(registry.Register(newRecordingCollector("a", events))).To(HaveOccurred())
+
+		create()
+		Expect(events.get()).To(Equal([]string{"a:create"}))
+	})
+
+	It("stops dispatching to and gathering from unregistered collectors", func() {
+		a := newRecordingCollector("a", events)
+		b := newRecordingCollector("b", events)
+		registry.MustRegister(a, b)
+		Expect(gatheredNames(registry)).To(Equal([]string{"a", "b"}))
+
+		Expect(registry.Unregister(a)).To(BeTrue())
+		create()
+		Expect(events.get()).To(Equal([]string{"b:create"}))
+		Expect(gatheredNames(registry)).To(Equal([]string{"b"}))
+	})
+
+	It("unregisters a collector through an equivalent instance", func() {
+		registry.MustRegister(newRecordingCollector("a", events))
+
+		Expect(registry.Unregister(newRecordingCollector("a", &eventLog{}))).To(BeTrue())
+		create()
+		Expect(events.get()).To(BeEmpty())
+	})
+
+	It("stops dispatching to a collector unregistered through one with other help", func() {
+		crInfo := NewCRInfoGauge()
+		registry.MustRegister(crInfo)
+		other := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "custom_resource_info",
+			Help: "Other help.",
+		}, []string{"namespace", "name", "created"})
+
+		Expect(registry.Unregister(other)).To(BeTrue())
+		Expect(registry.(*Registry).Collectors()).To(BeEmpty())
+
+		Expect(registry.Register(crInfo)).To(Succeed())
+		Expect(registry.(*Registry).Collectors()).To(HaveLen(1))
+	})
+
+	It("reports unknown collectors as not unregistered", func() {
+		registry.MustRegister(newRecordingCollector("a", events))
+
+		Expect(registry.Unregister(newRecordingCollector("b", events))).To(BeFalse())
+		create()
+		Expect(events.get()).To(Equal([]string{"a:create"}))
+	})
+
+	It("dispatches in registration order across re-registration", func() {
+		a := newRecordingCollector("a", events)
+		b := newRecordingCollector("b", events)
+		c := newRecordingCollector("c", events)
+		registry.MustRegister(a, b, c)
+		create()
+		Expect(events.get()).To(Equal([]string{"a:create", "b:create", "c:create"}))
+
+		Expect(registry.Unregister(a)).To(BeTrue())
+		registry.MustRegister(a)
+		events = &eventLog{}
+		a.log, b.log, c.log = events, events, events
+		create()
+		Expect(events.get()).To(Equal([]string{"b:create", "c:create", "a:create"}))
+	})
+
+	It("can register a collector again after unregistering it", func() {
+		a := newRecordingCollector("a", events)
+		registry.MustRegister(a)
+		Expect(registry.Unregister(a)).To(BeTrue())
+		Expect(registry.Unregister(a)).To(BeFalse())
+
+		Expect(registry.Register(a)).To(Succeed())
+		create()
+		Expect(events.get()).To(Equal([]string{"a:create"}))
+		Expect(gatheredNames(registry)).To(Equal([]string{"a"}))
+	})
+})
+
+var _ = Describe("Registry under concurrent use", func() {
+	// These specs are most useful when run with -race.
+	const (
+		workers    = 8
+		iterations = 200
+	)
+
+	It("dispatches events while collectors are registered and unregistered", func() {
+		registry := NewRegistry()
+		pred := registry.Predicate()
+		crInfo := NewCRInfoGauge()
+		registry.MustRegister(crInfo)
+		family, err := NewFamilyCollector(FamilyConfig{
+			Name:   "memcached_spec_size",
+			Type:   MetricTypeGauge,
+			Labels: []LabelConfig{{Name: "name", Path: ".metadata.name"}},
+			Value:  ".spec.size",
+		})
+		Expect(err).NotTo(HaveOccurred())
+		registry.MustRegister(family)
+
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(2)
+			go func(w int) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				for i := 0; i < iterations; i++ {
+					obj := newMemcached("example")
+					obj.Spec.Size = int32(i)
+					pred.Create(event.CreateEvent{Meta: obj, Object: obj})
+					pred.Update(event.UpdateEvent{MetaOld: obj, ObjectOld: obj, MetaNew: obj, ObjectNew: obj})
+					pred.Delete(event.DeleteEvent{Meta: obj, Object: obj})
+					pred.Generic(event.GenericEvent{Meta: obj, Object: obj})
+				}
+			}(w)
+			go func(w int) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				c := newRecordingCollector(fmt.Sprintf("worker_%d", w), &eventLog{})
+				for i := 0; i < iterations; i++ {
+					Expect(registry.Register(c)).To(Succeed())
+					_, err := registry.Gather()
+					Expect(err).NotTo(HaveOccurred())
+					Expect(registry.Unregister(c)).To(BeTrue())
+				}
+			}(w)
+		}
+		wg.Wait()
+
+		obj := newMemcached("example")
+		pred.Create(event.CreateEvent{Meta: obj, Object: obj})
+		Expect(gatheredNames(registry)).To(Equal([]string{"custom_resource_info", "memcached_spec_size"}))
+	})
+
+	It("keeps one series per object when events for it race", func() {
+		registry := NewRegistry()
+		pred := registry.Predicate()
+		family, err := NewFamilyCollector(FamilyConfig{
+			Name:   "memcached_spec_size",
+			Type:   MetricTypeGauge,
+			Labels: []LabelConfig{{Name: "size", Path: ".spec.size"}},
+			Value:  ".spec.size",
+		})
+		Expect(err).NotTo(HaveOccurred())
+		registry.MustRegister(family)
+
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				for i := 0; i < iterations; i++ {
+					obj := newMemcached("example")
+					obj.Spec.Size = int32(w*iterations + i)
+					pred.Update(event.UpdateEvent{MetaOld: obj, ObjectOld: obj, MetaNew: obj, ObjectNew: obj})
+				}
+			}(w)
+		}
+		wg.Wait()
+
+		mf := gatheredFamily(registry, "memcached_spec_size")
+		Expect(mf).NotTo(BeNil())
+		Expect(mf.GetMetric()).To(HaveLen(1))
+	})
+})
+
+// vetoCollector is a recording collector that also filters update events.
+type vetoCollector struct {
+	*recordingCollector
+	accept bool
+}
+
+func (c *vetoCollector) FilterUpdate(event.UpdateEvent) bool { return c.accept }
+
+var _ = Describe("Registry.FilterPredicate", func() {
+	var (
+		registry RegistererGathererPredicater
+		events   *eventLog
+		obj      *cachev1alpha1.Memcached
+	)
+
+	update := func(p predicate.Predicate) bool {
+		return p.Update(event.UpdateEvent{MetaOld: obj, ObjectOld: obj, MetaNew: obj, ObjectNew: obj})
+	}
+
+	BeforeEach(func() {
+		registry = NewRegistry()
+		events = &eventLog{}
+		obj = newMemcached("example")
+	})
+
+	It("passes events when no filters are registered", func() {
+		registry.MustRegister(newRecordingCollector("a", events))
+
+		Expect(update(registry.FilterPredicate(MatchAll))).To(BeTrue())
+		Expect(update(registry.FilterPredicate(MatchAny))).To(BeTrue())
+	})
+
+	It("records metrics even for vetoed events", func() {
+		registry.MustRegister(&vetoCollector{recordingCollector: newRecordingCollector("a", events)})
+
+		Expect(update(registry.FilterPredicate(MatchAll))).To(BeFalse())
+		Expect(events.get()).To(Equal([]string{"a:update"}))
+	})
+
+	It("combines verdicts according to the mode", func() {
+		registry.MustRegister(
+			&vetoCollector{recordingCollector: newRecordingCollector("a", events), accept: true},
+			&vetoCollector{recordingCollector: newRecordingCollector("b", events), accept: false},
+		)
+
+		Expect(update(registry.FilterPredicate(MatchAll))).To(BeFalse())
+		Expect(update(registry.FilterPredicate(MatchAny))).To(BeTrue())
+	})
+
+	It("only filters the event types a collector implements", func() {
+		registry.MustRegister(&vetoCollector{recordingCollector: newRecordingCollector("a", events)})
+
+		Expect(registry.FilterPredicate(MatchAll).Create(event.CreateEvent{Meta: obj, Object: obj})).To(BeTrue())
+	})
+
+	It("stops filtering once the filter is unregistered", func() {
+		veto := &vetoCollector{recordingCollector: newRecordingCollector("a", events)}
+		registry.MustRegister(veto)
+		p := registry.FilterPredicate(MatchAll)
+		Expect(update(p)).To(BeFalse())
+
+		Expect(registry.Unregister(veto)).To(BeTrue())
+		Expect(update(p)).To(BeTrue())
+	})
+})
+
+// panickingCollector panics on every update and in its update filter.
+type panickingCollector struct {
+	prometheus.Gauge
+}
+
+func (c *panickingCollector) Update(event.UpdateEvent)            { panic("update failed") }
+func (c *panickingCollector) FilterUpdate(event.UpdateEvent) bool { panic("filter failed") }
+
+var _ = Describe("Registry handler instrumentation", func() {
+	var (
+		registry RegistererGathererPredicater
+		events   *eventLog
+		obj      *cachev1alpha1.Memcached
+	)
+
+	BeforeEach(func() {
+		registry = NewRegistry()
+		events = &eventLog{}
+		obj = newMemcached("example")
+		registry.MustRegister(
+			&panickingCollector{Gauge: prometheus.NewGauge(prometheus.GaugeOpts{Name: "broken", Help: "broken"})},
+			newRecordingCollector("a", events),
+		)
+	})
+
+	It("recovers from a panicking handler and keeps dispatching", func() {
+		Expect(func() {
+			registry.Predicate().Update(event.UpdateEvent{MetaOld: obj, ObjectOld: obj, MetaNew: obj, ObjectNew: obj})
+		}).NotTo(Panic())
+		Expect(events.get()).To(Equal([]string{"a:update"}))
+	})
+
+	It("lets the event through when a filter panics", func() {
+		Expect(registry.FilterPredicate(MatchAll).Update(
+			event.UpdateEvent{MetaOld: obj, ObjectOld: obj, MetaNew: obj, ObjectNew: obj})).To(BeTrue())
+	})
+
+	It("counts failures and times handlers per collector", func() {
+		registry.Predicate().Update(event.UpdateEvent{MetaOld: obj, ObjectOld: obj, MetaNew: obj, ObjectNew: obj})
+
+		failures := gatheredFamily(registry, "metrics_handler_failures_total")
+		Expect(failures).NotTo(BeNil())
+		Expect(failures.GetMetric()).To(HaveLen(1))
+		Expect(failures.GetMetric()[0].GetLabel()).To(ConsistOf(
+			&dto.LabelPair{Name: proto.String("collector"), Value: proto.String("broken")},
+			&dto.LabelPair{Name: proto.String("event"), Value: proto.String("update")},
+		))
+		Expect(failures.GetMetric()[0].GetCounter().GetValue()).To(Equal(float64(1)))
+
+		durations := gatheredFamily(registry, "metrics_handler_duration_seconds")
+		Expect(durations).NotTo(BeNil())
+		Expect(durations.GetMetric()).To(HaveLen(2))
+	})
+
+	It("drops a collector's handler series when it is unregistered", func() {
+		registry.Predicate().Update(event.UpdateEvent{MetaOld: obj, ObjectOld: obj, MetaNew: obj, ObjectNew: obj})
+		Expect(registry.Unregister(prometheus.NewGauge(prometheus.GaugeOpts{Name: "broken", Help: "broken"}))).To(BeTrue())
+
+		Expect(gatheredFamily(registry, "metrics_handler_failures_total")).To(BeNil())
+		Expect(gatheredFamily(registry, "metrics_handler_duration_seconds").GetMetric()).To(HaveLen(1))
+	})
+})
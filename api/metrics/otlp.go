@@ -0,0 +1,487 @@
+/*
+Copyright 2020 The Operator-SDK Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// OTLPProtocol selects the transport of an OTLPExporter.
+type OTLPProtocol string
+
+const (
+	// OTLPGRPC exports over gRPC.
+	OTLPGRPC OTLPProtocol = "grpc"
+	// OTLPHTTP exports protobuf over HTTP.
+	OTLPHTTP OTLPProtocol = "http/protobuf"
+)
+
+const (
+	otlpExportMethod = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+	otlpHTTPPath     = "/v1/metrics"
+	otlpScopeName    = "github.com/bharathi-tenneti/memcached-operator-metrics/api/metrics"
+)
+
+// Semantic convention keys of the resource attributes describing the
+// operator.
+const (
+	OTLPServiceName      = "service.name"
+	OTLPK8sPodName       = "k8s.pod.name"
+	OTLPK8sNamespaceName = "k8s.namespace.name"
+	OTLPK8sClusterName   = "k8s.cluster.name"
+)
+
+// OTLPExporter periodically gathers metrics and exports them to an
+// OpenTelemetry collector over OTLP. Counters become monotonic cumulative
+// sums, gauges and untyped metrics gauges, and histograms and summaries keep
+// their type. Labels become data point attributes.
+type OTLPExporter struct {
+	// Gatherer provides the metrics, usually the custom metrics registry.
+	Gatherer prometheus.Gatherer
+	// Endpoint is host:port for gRPC, or the collector URL for HTTP. An
+	// HTTP URL without a path gets /v1/metrics.
+	Endpoint string
+	// Protocol selects the transport. Defaults to OTLPGRPC.
+	Protocol OTLPProtocol
+	// Insecure disables TLS for gRPC. HTTP follows the URL scheme.
+	Insecure bool
+	// Headers are sent with every export, e.g. for authentication.
+	Headers map[string]string
+	// ResourceAttributes describe the exporting operator, e.g. OTLPK8sPodName.
+	ResourceAttributes map[string]string
+	// Interval is the time between exports. Defaults to 1 minute.
+	Interval time.Duration
+	// Timeout bounds a single export. Defaults to 10 seconds.
+	Timeout time.Duration
+
+	mu         sync.Mutex
+	lastExport time.Time
+	starts     map[string]time.Time
+	conn       *grpc.ClientConn
+}
+
+// processStart approximates the process start time. No series can count
+// anything before the package is initialized.
+var processStart = time.Now()
+
+// NeedLeaderElection makes only the leader export, like Pusher.
+func (e *OTLPExporter) NeedLeaderElection() bool {
+	return true
+}
+
+// Start exports every Interval until stop is closed. Failed exports are
+// retried with backoff until the next export is due.
+func (e *OTLPExporter) Start(stop <-chan struct{}) error {
+	interval := durationOrDefault(e.Interval, defaultPushInterval)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+	defer e.Close()
+
+	log.Info("exporting metrics over OTLP", "endpoint", e.Endpoint, "protocol", e.protocol(), "interval", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		retryCtx, done := context.WithTimeout(ctx, interval)
+		if err := retryWithBackoff(retryCtx, 0, 0, e.Export); err != nil && ctx.Err() == nil {
+			log.Error(err, "unable to export metrics over OTLP", "endpoint", e.Endpoint)
+		}
+		done()
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// seriesStarts returns the start time of each gathered series. Series
+// present at the first export started with the process; series first seen
+// later started after the previous export. Series that are gone are
+// forgotten, so a recreated series gets a new start time.
+func (e *OTLPExporter) seriesStarts(mfs []*dto.MetricFamily, now time.Time) map[*dto.Metric]time.Time {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	since := e.lastExport
+	if since.IsZero() {
+		since = processStart
+	}
+	starts := make(map[string]time.Time, len(e.starts))
+	byMetric := map[*dto.Metric]time.Time{}
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			key := otlpSeriesKey(mf, m)
+			start, ok := e.starts[key]
+			if !ok {
+				start = since
+			}
+			starts[key] = start
+			byMetric[m] = start
+		}
+	}
+	e.starts = starts
+	e.lastExport = now
+	return byMetric
+}
+
+func otlpSeriesKey(mf *dto.MetricFamily, m *dto.Metric) string {
+	parts := []string{mf.GetName()}
+	for _, l := range m.GetLabel() {
+		parts = append(parts, l.GetName(), l.GetValue())
+	}
+	return seriesKey(parts)
+}
+
+// Close closes the gRPC connection, if any.
+func (e *OTLPExporter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.conn == nil {
+		return nil
+	}
+	err := e.conn.Close()
+	e.conn = nil
+	return err
+}
+
+// Export gathers the metrics and exports them once.
+func (e *OTLPExporter) Export(ctx context.Context) error {
+	mfs, err := e.Gatherer.Gather()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	req := encodeExportRequest(mfs, e.ResourceAttributes, e.seriesStarts(mfs, now), now)
+
+	ctx, cancel := context.WithTimeout(ctx, durationOrDefault(e.Timeout, defaultPushTimeout))
+	defer cancel()
+	switch e.protocol() {
+	case OTLPGRPC:
+		return e.exportGRPC(ctx, req)
+	case OTLPHTTP:
+		return e.exportHTTP(ctx, req)
+	default:
+		return permanentError{fmt.Errorf("unknown OTLP protocol %q", e.Protocol)}
+	}
+}
+
+func (e *OTLPExporter) protocol() OTLPProtocol {
+	if e.Protocol == "" {
+		return OTLPGRPC
+	}
+	return e.Protocol
+}
+
+func (e *OTLPExporter) exportGRPC(ctx context.Context, req []byte) error {
+	conn, err := e.dial()
+	if err != nil {
+		return permanentError{err}
+	}
+	md := make([]string, 0, 2*len(e.Headers))
+	for k, v := range e.Headers {
+		md = append(md, k, v)
+	}
+	var resp []byte
+	err = conn.Invoke(metadata.AppendToOutgoingContext(ctx, md...), otlpExportMethod, req, &resp, grpc.ForceCodec(rawCodec{}))
+	switch status.Code(err) {
+	case codes.OK:
+		return nil
+	case codes.Canceled, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted,
+		codes.OutOfRange, codes.Unavailable, codes.DataLoss:
+		return err
+	default:
+		return permanentError{err}
+	}
+}
+
+func (e *OTLPExporter) dial() (*grpc.ClientConn, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.conn != nil {
+		return e.conn, nil
+	}
+	opt := grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12}))
+	if e.Insecure {
+		opt = grpc.WithInsecure()
+	}
+	conn, err := grpc.Dial(e.Endpoint, opt)
+	if err != nil {
+		return nil, err
+	}
+	e.conn = conn
+	return conn, nil
+}
+
+func (e *OTLPExporter) exportHTTP(ctx context.Context, body []byte) error {
+	u, err := url.Parse(e.Endpoint)
+	if err != nil {
+		return permanentError{err}
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = otlpHTTPPath
+	}
+	req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	for k, v := range e.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("OTLP export returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	if resp.StatusCode/100 != 5 && resp.StatusCode != http.StatusTooManyRequests {
+		return permanentError{err}
+	}
+	return err
+}
+
+// rawCodec passes already encoded protobuf messages through gRPC, so the
+// OTLP types need not be generated.
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	b, ok := v.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("rawCodec: cannot marshal %T", v)
+	}
+	return b, nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("rawCodec: cannot unmarshal into %T", v)
+	}
+	*b = append((*b)[:0], data...)
+	return nil
+}
+
+func (rawCodec) Name() string {
+	return "proto"
+}
+
+// encodeExportRequest encodes the gathered families as an OTLP
+// ExportMetricsServiceRequest with a single resource and scope. Series
+// missing from starts start at now.
+func encodeExportRequest(mfs []*dto.MetricFamily, resource map[string]string, starts map[*dto.Metric]time.Time, now time.Time) []byte {
+	var scope []byte
+	scope = protowire.AppendTag(scope, 1, protowire.BytesType)
+	scope = protowire.AppendString(scope, otlpScopeName)
+
+	var scopeMetrics []byte
+	scopeMetrics = appendMessage(scopeMetrics, 1, scope)
+	for _, mf := range mfs {
+		if metric := encodeOTLPMetric(mf, starts, now); metric != nil {
+			scopeMetrics = appendMessage(scopeMetrics, 2, metric)
+		}
+	}
+
+	var res []byte
+	for _, kv := range encodeAttributes(resource) {
+		res = appendMessage(res, 1, kv)
+	}
+	var resourceMetrics []byte
+	resourceMetrics = appendMessage(resourceMetrics, 1, res)
+	resourceMetrics = appendMessage(resourceMetrics, 2, scopeMetrics)
+
+	return appendMessage(nil, 1, resourceMetrics)
+}
+
+const otlpCumulative = 2
+
+func encodeOTLPMetric(mf *dto.MetricFamily, starts map[*dto.Metric]time.Time, t time.Time) []byte {
+	now := uint64(t.UnixNano())
+	start := func(m *dto.Metric) uint64 {
+		if s, ok := starts[m]; ok {
+			return uint64(s.UnixNano())
+		}
+		return now
+	}
+	var data []byte
+	var field protowire.Number
+	switch mf.GetType() {
+	case dto.MetricType_COUNTER:
+		field = 7
+		for _, m := range mf.GetMetric() {
+			data = appendMessage(data, 1, encodeNumberPoint(m, m.GetCounter().GetValue(), start(m), now))
+		}
+		data = protowire.AppendTag(data, 2, protowire.VarintType)
+		data = protowire.AppendVarint(data, otlpCumulative)
+		data = protowire.AppendTag(data, 3, protowire.VarintType)
+		data = protowire.AppendVarint(data, 1)
+	case dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+		field = 5
+		for _, m := range mf.GetMetric() {
+			v := m.GetGauge().GetValue()
+			if mf.GetType() == dto.MetricType_UNTYPED {
+				v = m.GetUntyped().GetValue()
+			}
+			data = appendMessage(data, 1, encodeNumberPoint(m, v, start(m), now))
+		}
+	case dto.MetricType_HISTOGRAM:
+		field = 9
+		for _, m := range mf.GetMetric() {
+			data = appendMessage(data, 1, encodeHistogramPoint(m, start(m), now))
+		}
+		data = protowire.AppendTag(data, 2, protowire.VarintType)
+		data = protowire.AppendVarint(data, otlpCumulative)
+	case dto.MetricType_SUMMARY:
+		field = 11
+		for _, m := range mf.GetMetric() {
+			data = appendMessage(data, 1, encodeSummaryPoint(m, start(m), now))
+		}
+	default:
+		return nil
+	}
+
+	var metric []byte
+	metric = protowire.AppendTag(metric, 1, protowire.BytesType)
+	metric = protowire.AppendString(metric, mf.GetName())
+	metric = protowire.AppendTag(metric, 2, protowire.BytesType)
+	metric = protowire.AppendString(metric, mf.GetHelp())
+	return appendMessage(metric, field, data)
+}
+
+func encodeNumberPoint(m *dto.Metric, value float64, start, now uint64) []byte {
+	var p []byte
+	p = appendTimes(p, start, now)
+	p = protowire.AppendTag(p, 4, protowire.Fixed64Type)
+	p = protowire.AppendFixed64(p, math.Float64bits(value))
+	return appendLabels(p, 7, m)
+}
+
+// encodeHistogramPoint converts the cumulative Prometheus buckets to the
+// per-bucket counts OTLP expects. The +Inf bound is implicit in OTLP.
+func encodeHistogramPoint(m *dto.Metric, start, now uint64) []byte {
+	h := m.GetHistogram()
+	var bounds, counts []byte
+	var prev uint64
+	for _, b := range h.GetBucket() {
+		if math.IsInf(b.GetUpperBound(), +1) {
+			continue
+		}
+		bounds = protowire.AppendFixed64(bounds, math.Float64bits(b.GetUpperBound()))
+		counts = protowire.AppendFixed64(counts, b.GetCumulativeCount()-prev)
+		prev = b.GetCumulativeCount()
+	}
+	counts = protowire.AppendFixed64(counts, h.GetSampleCount()-prev)
+
+	var p []byte
+	p = appendTimes(p, start, now)
+	p = protowire.AppendTag(p, 4, protowire.Fixed64Type)
+	p = protowire.AppendFixed64(p, h.GetSampleCount())
+	p = protowire.AppendTag(p, 5, protowire.Fixed64Type)
+	p = protowire.AppendFixed64(p, math.Float64bits(h.GetSampleSum()))
+	p = appendMessage(p, 6, counts)
+	p = appendMessage(p, 7, bounds)
+	return appendLabels(p, 9, m)
+}
+
+func encodeSummaryPoint(m *dto.Metric, start, now uint64) []byte {
+	s := m.GetSummary()
+	var p []byte
+	p = appendTimes(p, start, now)
+	p = protowire.AppendTag(p, 4, protowire.Fixed64Type)
+	p = protowire.AppendFixed64(p, s.GetSampleCount())
+	p = protowire.AppendTag(p, 5, protowire.Fixed64Type)
+	p = protowire.AppendFixed64(p, math.Float64bits(s.GetSampleSum()))
+	for _, q := range s.GetQuantile() {
+		var v []byte
+		v = protowire.AppendTag(v, 1, protowire.Fixed64Type)
+		v = protowire.AppendFixed64(v, math.Float64bits(q.GetQuantile()))
+		v = protowire.AppendTag(v, 2, protowire.Fixed64Type)
+		v = protowire.AppendFixed64(v, math.Float64bits(q.GetValue()))
+		p = appendMessage(p, 6, v)
+	}
+	return appendLabels(p, 7, m)
+}
+
+func appendTimes(b []byte, start, now uint64) []byte {
+	b = protowire.AppendTag(b, 2, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, start)
+	b = protowire.AppendTag(b, 3, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, now)
+}
+
+func appendLabels(b []byte, field protowire.Number, m *dto.Metric) []byte {
+	labels := make(map[string]string, len(m.GetLabel()))
+	for _, l := range m.GetLabel() {
+		labels[l.GetName()] = l.GetValue()
+	}
+	for _, kv := range encodeAttributes(labels) {
+		b = appendMessage(b, field, kv)
+	}
+	return b
+}
+
+// encodeAttributes encodes attrs as string KeyValue messages, sorted by key.
+func encodeAttributes(attrs map[string]string) [][]byte {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	kvs := make([][]byte, 0, len(keys))
+	for _, k := range keys {
+		var value []byte
+		value = protowire.AppendTag(value, 1, protowire.BytesType)
+		value = protowire.AppendString(value, attrs[k])
+		var kv []byte
+		kv = protowire.AppendTag(kv, 1, protowire.BytesType)
+		kv = protowire.AppendString(kv, k)
+		kvs = append(kvs, appendMessage(kv, 2, value))
+	}
+	return kvs
+}
+
+func appendMessage(b []byte, field protowire.Number, msg []byte) []byte {
+	b = protowire.AppendTag(b, field, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
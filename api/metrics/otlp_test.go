@@ -0,0 +1,318 @@
+/*
+Copyright 2020 The Operator-SDK Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http/httptest"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+// pbField is a decoded protobuf field. Bytes holds length-delimited
+// content, Fixed64 and Varint the other wire types.
+type pbField struct {
+	Num     protowire.Number
+	Bytes   []byte
+	Fixed64 uint64
+	Varint  uint64
+}
+
+func pbFields(b []byte) []pbField {
+	var fields []pbField
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		Expect(n).To(BeNumerically(">", 0))
+		b = b[n:]
+		f := pbField{Num: num}
+		switch typ {
+		case protowire.BytesType:
+			f.Bytes, n = protowire.ConsumeBytes(b)
+		case protowire.Fixed64Type:
+			f.Fixed64, n = protowire.ConsumeFixed64(b)
+		case protowire.VarintType:
+			f.Varint, n = protowire.ConsumeVarint(b)
+		default:
+			Fail("unexpected wire type")
+		}
+		Expect(n).To(BeNumerically(">", 0))
+		b = b[n:]
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// pbGet returns the fields of b with number num.
+func pbGet(b []byte, num protowire.Number) []pbField {
+	var fields []pbField
+	for _, f := range pbFields(b) {
+		if f.Num == num {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// pbAttributes decodes the string KeyValue messages in field num of b.
+func pbAttributes(b []byte, num protowire.Number) map[string]string {
+	attrs := map[string]string{}
+	for _, kv := range pbGet(b, num) {
+		key := string(pbGet(kv.Bytes, 1)[0].Bytes)
+		value := pbGet(kv.Bytes, 2)[0].Bytes
+		attrs[key] = string(pbGet(value, 1)[0].Bytes)
+	}
+	return attrs
+}
+
+// otlpMetrics returns the resource attributes of an export request and its
+// Metric messages by name.
+func otlpMetrics(req []byte) (map[string]string, map[string][]byte) {
+	rms := pbGet(req, 1)
+	Expect(rms).To(HaveLen(1))
+	resource := pbGet(rms[0].Bytes, 1)[0].Bytes
+	scopeMetrics := pbGet(rms[0].Bytes, 2)
+	Expect(scopeMetrics).To(HaveLen(1))
+
+	metrics := map[string][]byte{}
+	for _, m := range pbGet(scopeMetrics[0].Bytes, 2) {
+		metrics[string(pbGet(m.Bytes, 1)[0].Bytes)] = m.Bytes
+	}
+	return pbAttributes(resource, 1), metrics
+}
+
+// sumPointTimes returns the start and time of the points of the named Sum
+// metric of an export request by their kind attribute.
+func sumPointTimes(req []byte, name string) map[string][2]uint64 {
+	_, metrics := otlpMetrics(req)
+	sum := pbGet(metrics[name], 7)
+	Expect(sum).To(HaveLen(1))
+	times := map[string][2]uint64{}
+	for _, p := range pbGet(sum[0].Bytes, 1) {
+		kind := pbAttributes(p.Bytes, 7)["kind"]
+		times[kind] = [2]uint64{pbGet(p.Bytes, 2)[0].Fixed64, pbGet(p.Bytes, 3)[0].Fixed64}
+	}
+	return times
+}
+
+// rawServerCodec adapts rawCodec to the codec interface of grpc.CustomCodec.
+type rawServerCodec struct {
+	rawCodec
+}
+
+func (rawServerCodec) String() string {
+	return "raw"
+}
+
+// otlpCollector is a stand-in OTLP gRPC collector that fails with the queued
+// codes, then succeeds.
+type otlpCollector struct {
+	mu       sync.Mutex
+	failures []codes.Code
+	methods  []string
+	headers  []metadata.MD
+	requests [][]byte
+}
+
+func (c *otlpCollector) handle(_ interface{}, stream grpc.ServerStream) error {
+	var req []byte
+	if err := stream.RecvMsg(&req); err != nil {
+		return err
+	}
+	method, _ := grpc.MethodFromServerStream(stream)
+	md, _ := metadata.FromIncomingContext(stream.Context())
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.methods = append(c.methods, method)
+	c.headers = append(c.headers, md)
+	c.requests = append(c.requests, req)
+	if len(c.failures) > 0 {
+		code := c.failures[0]
+		c.failures = c.failures[1:]
+		return status.Error(code, "injected failure")
+	}
+	return stream.SendMsg([]byte{})
+}
+
+var _ = Describe("OTLPExporter", func() {
+	var registry RegistererGathererPredicater
+
+	BeforeEach(func() {
+		registry = NewRegistry()
+		registry.MustRegister(NewCRInfoGauge())
+		obj := newMemcached("example")
+		registry.Predicate().Create(event.CreateEvent{Meta: obj, Object: obj})
+	})
+
+	Context("over HTTP", func() {
+		var (
+			recv *receiver
+			srv  *httptest.Server
+		)
+
+		BeforeEach(func() {
+			recv = &receiver{}
+			srv = httptest.NewServer(recv)
+		})
+
+		AfterEach(func() {
+			srv.Close()
+		})
+
+		It("posts the metrics with the resource attributes", func() {
+			e := &OTLPExporter{
+				Gatherer: registry,
+				Endpoint: srv.URL,
+				Protocol: OTLPHTTP,
+				Headers:  map[string]string{"Authorization": "Bearer secret"},
+				ResourceAttributes: map[string]string{
+					OTLPK8sPodName:     "memcached-operator-0",
+					OTLPK8sClusterName: "east",
+				},
+			}
+			Expect(e.Export(context.Background())).To(Succeed())
+
+			Expect(recv.requests).To(HaveLen(1))
+			req := recv.requests[0]
+			Expect(req.URL.Path).To(Equal("/v1/metrics"))
+			Expect(req.Header.Get("Content-Type")).To(Equal("application/x-protobuf"))
+			Expect(req.Header.Get("Authorization")).To(Equal("Bearer secret"))
+
+			resource, metrics := otlpMetrics(recv.bodies[0])
+			Expect(resource).To(Equal(map[string]string{
+				"k8s.pod.name":     "memcached-operator-0",
+				"k8s.cluster.name": "east",
+			}))
+
+			gauge := pbGet(metrics["custom_resource_info"], 5)
+			Expect(gauge).To(HaveLen(1))
+			points := pbGet(gauge[0].Bytes, 1)
+			Expect(points).To(HaveLen(1))
+			Expect(math.Float64frombits(pbGet(points[0].Bytes, 4)[0].Fixed64)).To(Equal(1.0))
+			Expect(pbAttributes(points[0].Bytes, 7)).To(HaveKeyWithValue("name", "example"))
+		})
+
+		It("starts series at process start or when first seen", func() {
+			widgets := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "widgets_total", Help: "Widgets."}, []string{"kind"})
+			registry.MustRegister(widgets)
+			widgets.WithLabelValues("a").Inc()
+			e := &OTLPExporter{Gatherer: registry, Endpoint: srv.URL, Protocol: OTLPHTTP}
+
+			Expect(e.Export(context.Background())).To(Succeed())
+			first := sumPointTimes(recv.bodies[0], "widgets_total")
+			Expect(first["a"][0]).To(Equal(uint64(processStart.UnixNano())))
+
+			widgets.WithLabelValues("b").Inc()
+			Expect(e.Export(context.Background())).To(Succeed())
+			second := sumPointTimes(recv.bodies[1], "widgets_total")
+			Expect(second["a"][0]).To(Equal(first["a"][0]))
+			Expect(second["b"][0]).To(Equal(first["a"][1]))
+
+			widgets.DeleteLabelValues("a")
+			Expect(e.Export(context.Background())).To(Succeed())
+			widgets.WithLabelValues("a").Inc()
+			Expect(e.Export(context.Background())).To(Succeed())
+			fourth := sumPointTimes(recv.bodies[3], "widgets_total")
+			Expect(fourth["a"][0]).To(Equal(sumPointTimes(recv.bodies[2], "widgets_total")["b"][1]))
+			Expect(fourth["b"][0]).To(Equal(second["b"][0]))
+		})
+
+		It("converts cumulative buckets to per-bucket counts", func() {
+			e := &OTLPExporter{Gatherer: registry, Endpoint: srv.URL, Protocol: OTLPHTTP}
+			Expect(e.Export(context.Background())).To(Succeed())
+
+			_, metrics := otlpMetrics(recv.bodies[0])
+			histogram := pbGet(metrics["metrics_handler_duration_seconds"], 9)
+			Expect(histogram).To(HaveLen(1))
+			Expect(pbGet(histogram[0].Bytes, 2)[0].Varint).To(Equal(uint64(otlpCumulative)))
+			point := pbGet(histogram[0].Bytes, 1)[0].Bytes
+			Expect(pbGet(point, 4)[0].Fixed64).To(Equal(uint64(1)))
+
+			counts := pbGet(point, 6)[0].Bytes
+			bounds := pbGet(point, 7)[0].Bytes
+			Expect(len(bounds) / 8).To(Equal(10))
+			Expect(len(counts) / 8).To(Equal(11))
+			var total uint64
+			for len(counts) > 0 {
+				v, n := protowire.ConsumeFixed64(counts)
+				total += v
+				counts = counts[n:]
+			}
+			Expect(total).To(Equal(uint64(1)))
+		})
+	})
+
+	Context("over gRPC", func() {
+		var (
+			collector *otlpCollector
+			server    *grpc.Server
+			addr      string
+		)
+
+		BeforeEach(func() {
+			collector = &otlpCollector{}
+			server = grpc.NewServer(grpc.CustomCodec(rawServerCodec{}), grpc.UnknownServiceHandler(collector.handle))
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			addr = l.Addr().String()
+			go server.Serve(l)
+		})
+
+		AfterEach(func() {
+			server.Stop()
+		})
+
+		It("calls the metrics service export method", func() {
+			e := &OTLPExporter{
+				Gatherer:           registry,
+				Endpoint:           addr,
+				Insecure:           true,
+				Headers:            map[string]string{"x-tenant": "operators"},
+				ResourceAttributes: map[string]string{OTLPServiceName: "memcached-operator"},
+			}
+			defer e.Close()
+			Expect(e.Export(context.Background())).To(Succeed())
+
+			Expect(collector.methods).To(Equal([]string{otlpExportMethod}))
+			Expect(collector.headers[0].Get("x-tenant")).To(Equal([]string{"operators"}))
+			resource, metrics := otlpMetrics(collector.requests[0])
+			Expect(resource).To(Equal(map[string]string{"service.name": "memcached-operator"}))
+			Expect(metrics).To(HaveKey("custom_resource_info"))
+		})
+
+		It("retries unavailable collectors but not rejected requests", func() {
+			collector.failures = []codes.Code{codes.Unavailable, codes.InvalidArgument}
+			e := &OTLPExporter{Gatherer: registry, Endpoint: addr, Insecure: true}
+			defer e.Close()
+
+			err := retryWithBackoff(context.Background(), 1, 1, e.Export)
+			Expect(status.Code(err.(permanentError).error)).To(Equal(codes.InvalidArgument))
+			Expect(collector.requests).To(HaveLen(2))
+		})
+	})
+})
@@ -0,0 +1,356 @@
+/*
+Copyright 2020 The Operator-SDK Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// PushMode selects the protocol a Pusher speaks.
+type PushMode string
+
+const (
+	// PushGateway replaces the job's metrics on a Prometheus Pushgateway.
+	PushGateway PushMode = "pushgateway"
+	// PushRemoteWrite sends samples to a Prometheus remote-write endpoint.
+	PushRemoteWrite PushMode = "remote-write"
+)
+
+const (
+	defaultPushInterval   = time.Minute
+	defaultPushTimeout    = 10 * time.Second
+	defaultPushJob        = "memcached-operator"
+	defaultPushMinBackoff = time.Second
+	defaultPushMaxBackoff = 30 * time.Second
+)
+
+// Pusher periodically gathers metrics and pushes them to a Pushgateway or a
+// remote-write receiver, for clusters that cannot be scraped. Failed pushes
+// are retried with exponential backoff until the next push is due.
+type Pusher struct {
+	// Gatherer provides the metrics, usually the custom metrics registry.
+	Gatherer prometheus.Gatherer
+	// URL is the Pushgateway base URL or the remote-write endpoint.
+	URL string
+	// Mode selects the protocol. Defaults to PushGateway.
+	Mode PushMode
+	// Job is the Pushgateway job, and the job label of remote-written
+	// series. Defaults to "memcached-operator".
+	Job string
+	// Labels are added to every pushed series, e.g. to tell clusters apart.
+	// For a Pushgateway they form the grouping key.
+	Labels map[string]string
+	// Interval is the time between pushes. Defaults to 1 minute.
+	Interval time.Duration
+	// Client sends the requests. Defaults to a client with a 10 second
+	// timeout.
+	Client *http.Client
+	// MinBackoff and MaxBackoff bound the delay between retries of a failed
+	// push. They default to 1 and 30 seconds.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// NeedLeaderElection makes only the leader push, so replicas do not send
+// conflicting copies of the same series.
+func (p *Pusher) NeedLeaderElection() bool {
+	return true
+}
+
+// Start pushes every Interval until stop is closed.
+func (p *Pusher) Start(stop <-chan struct{}) error {
+	interval := durationOrDefault(p.Interval, defaultPushInterval)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	log.Info("pushing metrics", "url", p.URL, "mode", p.mode(), "interval", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		// A retry never runs into the next push, which sends fresher data.
+		retryCtx, done := context.WithTimeout(ctx, interval)
+		if err := p.pushWithRetry(retryCtx); err != nil && ctx.Err() == nil {
+			log.Error(err, "unable to push metrics", "url", p.URL)
+		}
+		done()
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Pusher) pushWithRetry(ctx context.Context) error {
+	return retryWithBackoff(ctx, p.MinBackoff, p.MaxBackoff, p.Push)
+}
+
+// retryWithBackoff calls fn until it succeeds, fails with a permanentError
+// or ctx ends, doubling the delay between calls from minBackoff up to
+// maxBackoff.
+func retryWithBackoff(ctx context.Context, minBackoff, maxBackoff time.Duration, fn func(context.Context) error) error {
+	backoff := durationOrDefault(minBackoff, defaultPushMinBackoff)
+	maxBackoff = durationOrDefault(maxBackoff, defaultPushMaxBackoff)
+	for {
+		err := fn(ctx)
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(permanentError); ok {
+			return err
+		}
+		log.V(1).Info("retrying metrics push", "reason", err.Error(), "backoff", backoff)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// permanentError is a push failure that retrying cannot fix.
+type permanentError struct {
+	error
+}
+
+// Push gathers the metrics and pushes them once.
+func (p *Pusher) Push(ctx context.Context) error {
+	switch p.mode() {
+	case PushGateway:
+		return p.pushGateway(ctx)
+	case PushRemoteWrite:
+		return p.remoteWrite(ctx)
+	default:
+		return permanentError{fmt.Errorf("unknown push mode %q", p.Mode)}
+	}
+}
+
+func (p *Pusher) mode() PushMode {
+	if p.Mode == "" {
+		return PushGateway
+	}
+	return p.Mode
+}
+
+func (p *Pusher) job() string {
+	if p.Job == "" {
+		return defaultPushJob
+	}
+	return p.Job
+}
+
+func (p *Pusher) client() *http.Client {
+	if p.Client == nil {
+		return &http.Client{Timeout: defaultPushTimeout}
+	}
+	return p.Client
+}
+
+func (p *Pusher) pushGateway(ctx context.Context) error {
+	pusher := push.New(p.URL, p.job()).
+		Gatherer(p.Gatherer).
+		Client(contextDoer{ctx: ctx, client: p.client()})
+	for name, value := range p.Labels {
+		pusher = pusher.Grouping(name, value)
+	}
+	return pusher.Push()
+}
+
+// contextDoer sends every request with ctx, since the push package does not
+// take one.
+type contextDoer struct {
+	ctx    context.Context
+	client *http.Client
+}
+
+func (d contextDoer) Do(req *http.Request) (*http.Response, error) {
+	return d.client.Do(req.WithContext(d.ctx))
+}
+
+func (p *Pusher) remoteWrite(ctx context.Context) error {
+	mfs, err := p.Gatherer.Gather()
+	if err != nil {
+		return err
+	}
+	labels := map[string]string{"job": p.job()}
+	for name, value := range p.Labels {
+		labels[name] = value
+	}
+	body := snappy.Encode(nil, encodeWriteRequest(mfs, labels, time.Now()))
+
+	req, err := http.NewRequest(http.MethodPost, p.URL, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	resp, err := p.client().Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("remote write returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	// Like Prometheus, only server errors and throttling are retried.
+	if resp.StatusCode/100 != 5 && resp.StatusCode != http.StatusTooManyRequests {
+		return permanentError{err}
+	}
+	return err
+}
+
+// encodeWriteRequest encodes the gathered families as a remote-write
+// WriteRequest protobuf. Every series gets the extra labels and a single
+// sample at now. Summaries and histograms are split into their _sum, _count
+// and quantile or _bucket series as in the text format.
+func encodeWriteRequest(mfs []*dto.MetricFamily, extra map[string]string, now time.Time) []byte {
+	ts := now.UnixNano() / int64(time.Millisecond)
+	var buf []byte
+	add := func(name string, m *dto.Metric, value float64, label ...string) {
+		labels := make(map[string]string, len(extra)+len(m.GetLabel())+2)
+		for k, v := range extra {
+			labels[k] = v
+		}
+		for _, l := range m.GetLabel() {
+			labels[l.GetName()] = l.GetValue()
+		}
+		for i := 0; i+1 < len(label); i += 2 {
+			labels[label[i]] = label[i+1]
+		}
+		labels["__name__"] = name
+		sampleTS := ts
+		if m.TimestampMs != nil {
+			sampleTS = m.GetTimestampMs()
+		}
+		buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, encodeTimeSeries(labels, value, sampleTS))
+	}
+
+	for _, mf := range mfs {
+		name := mf.GetName()
+		for _, m := range mf.GetMetric() {
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add(name, m, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add(name, m, m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add(name, m, m.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.GetQuantile() {
+					add(name, m, q.GetValue(), "quantile", formatFloat(q.GetQuantile()))
+				}
+				add(name+"_sum", m, s.GetSampleSum())
+				add(name+"_count", m, float64(s.GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				infSeen := false
+				for _, b := range h.GetBucket() {
+					if math.IsInf(b.GetUpperBound(), +1) {
+						infSeen = true
+					}
+					add(name+"_bucket", m, float64(b.GetCumulativeCount()), "le", formatFloat(b.GetUpperBound()))
+				}
+				if !infSeen {
+					add(name+"_bucket", m, float64(h.GetSampleCount()), "le", "+Inf")
+				}
+				add(name+"_sum", m, h.GetSampleSum())
+				add(name+"_count", m, float64(h.GetSampleCount()))
+			}
+		}
+	}
+	return buf
+}
+
+// encodeTimeSeries encodes a TimeSeries message with labels sorted by name,
+// as remote-write receivers require, and a single sample.
+func encodeTimeSeries(labels map[string]string, value float64, timestampMs int64) []byte {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf []byte
+	for _, name := range names {
+		var label []byte
+		label = protowire.AppendTag(label, 1, protowire.BytesType)
+		label = protowire.AppendString(label, name)
+		label = protowire.AppendTag(label, 2, protowire.BytesType)
+		label = protowire.AppendString(label, labels[name])
+		buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, label)
+	}
+	var sample []byte
+	sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+	sample = protowire.AppendFixed64(sample, math.Float64bits(value))
+	sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+	sample = protowire.AppendVarint(sample, uint64(timestampMs))
+	buf = protowire.AppendTag(buf, 2, protowire.BytesType)
+	buf = protowire.AppendBytes(buf, sample)
+	return buf
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// ParseLabels parses a comma separated list of name=value pairs.
+func ParseLabels(s string) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || !model.LabelName(parts[0]).IsValid() {
+			return nil, fmt.Errorf("invalid label %q: expected name=value", item)
+		}
+		labels[parts[0]] = parts[1]
+	}
+	return labels, nil
+}
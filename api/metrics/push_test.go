@@ -0,0 +1,245 @@
+/*
+Copyright 2020 The Operator-SDK Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"google.golang.org/protobuf/encoding/protowire"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+// writtenSeries is a decoded remote-write time series with one sample.
+type writtenSeries struct {
+	Labels    []string
+	Value     float64
+	Timestamp int64
+}
+
+// decodeWriteRequest decodes a snappy compressed remote-write request.
+// Labels are flattened to name, value pairs in their encoded order.
+func decodeWriteRequest(body []byte) []writtenSeries {
+	data, err := snappy.Decode(nil, body)
+	Expect(err).NotTo(HaveOccurred())
+
+	var series []writtenSeries
+	fields(data, func(num protowire.Number, ts []byte) {
+		Expect(num).To(Equal(protowire.Number(1)))
+		s := writtenSeries{}
+		fields(ts, func(num protowire.Number, b []byte) {
+			switch num {
+			case 1:
+				fields(b, func(_ protowire.Number, v []byte) {
+					s.Labels = append(s.Labels, string(v))
+				})
+			case 2:
+				Expect(b).NotTo(BeEmpty())
+				_, _, n := protowire.ConsumeTag(b)
+				bits, m := protowire.ConsumeFixed64(b[n:])
+				s.Value = math.Float64frombits(bits)
+				b = b[n+m:]
+				_, _, n = protowire.ConsumeTag(b)
+				ts, _ := protowire.ConsumeVarint(b[n:])
+				s.Timestamp = int64(ts)
+			}
+		})
+		series = append(series, s)
+	})
+	return series
+}
+
+// fields calls fn with the number and content of every length-delimited
+// field in b.
+func fields(b []byte, fn func(protowire.Number, []byte)) {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		Expect(n).To(BeNumerically(">", 0))
+		Expect(typ).To(Equal(protowire.BytesType))
+		v, m := protowire.ConsumeBytes(b[n:])
+		Expect(m).To(BeNumerically(">", 0))
+		fn(num, v)
+		b = b[n+m:]
+	}
+}
+
+// receiver is a stand-in Pushgateway or remote-write endpoint that answers
+// with the queued status codes, then with 200.
+type receiver struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	Expect(err).NotTo(HaveOccurred())
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, req)
+	r.bodies = append(r.bodies, body)
+	if len(r.statuses) > 0 {
+		w.WriteHeader(r.statuses[0])
+		r.statuses = r.statuses[1:]
+	}
+}
+
+func (r *receiver) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.requests)
+}
+
+var _ = Describe("Pusher", func() {
+	var (
+		recv     *receiver
+		srv      *httptest.Server
+		registry RegistererGathererPredicater
+	)
+
+	BeforeEach(func() {
+		recv = &receiver{}
+		srv = httptest.NewServer(recv)
+		registry = NewRegistry()
+		registry.MustRegister(NewCRInfoGauge())
+		obj := newMemcached("example")
+		registry.Predicate().Create(event.CreateEvent{Meta: obj, Object: obj})
+	})
+
+	AfterEach(func() {
+		srv.Close()
+	})
+
+	It("replaces the job's metrics on a Pushgateway", func() {
+		p := &Pusher{
+			Gatherer: registry,
+			URL:      srv.URL,
+			Labels:   map[string]string{"cluster": "east"},
+		}
+		Expect(p.Push(context.Background())).To(Succeed())
+
+		Expect(recv.requests).To(HaveLen(1))
+		Expect(recv.requests[0].Method).To(Equal(http.MethodPut))
+		Expect(recv.requests[0].URL.Path).To(Equal("/metrics/job/memcached-operator/cluster/east"))
+	})
+
+	It("sends snappy compressed protobuf to a remote-write endpoint", func() {
+		p := &Pusher{
+			Gatherer: registry,
+			URL:      srv.URL + "/api/v1/write",
+			Mode:     PushRemoteWrite,
+			Labels:   map[string]string{"cluster": "east"},
+		}
+		before := time.Now()
+		Expect(p.Push(context.Background())).To(Succeed())
+
+		Expect(recv.requests).To(HaveLen(1))
+		req := recv.requests[0]
+		Expect(req.Method).To(Equal(http.MethodPost))
+		Expect(req.URL.Path).To(Equal("/api/v1/write"))
+		Expect(req.Header.Get("Content-Encoding")).To(Equal("snappy"))
+		Expect(req.Header.Get("Content-Type")).To(Equal("application/x-protobuf"))
+		Expect(req.Header.Get("X-Prometheus-Remote-Write-Version")).To(Equal("0.1.0"))
+
+		var info []writtenSeries
+		buckets := 0
+		for _, s := range decodeWriteRequest(recv.bodies[0]) {
+			Expect(s.Timestamp).To(BeNumerically(">=", before.UnixNano()/int64(time.Millisecond)))
+			switch s.Labels[1] {
+			case "custom_resource_info":
+				info = append(info, s)
+			case "metrics_handler_duration_seconds_bucket":
+				buckets++
+			}
+		}
+		Expect(info).To(HaveLen(1))
+		Expect(info[0].Value).To(Equal(1.0))
+		Expect(info[0].Labels).To(Equal([]string{
+			"__name__", "custom_resource_info",
+			"cluster", "east",
+			"created", "0001-01-01 00:00:00 +0000 UTC",
+			"job", "memcached-operator",
+			"name", "example",
+			"namespace", "default",
+		}))
+		// Ten buckets and +Inf for the create handler.
+		Expect(buckets).To(Equal(11))
+	})
+
+	It("retries server errors with backoff", func() {
+		recv.statuses = []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}
+		p := &Pusher{
+			Gatherer:   registry,
+			URL:        srv.URL,
+			Mode:       PushRemoteWrite,
+			MinBackoff: time.Millisecond,
+		}
+		Expect(p.pushWithRetry(context.Background())).To(Succeed())
+		Expect(recv.count()).To(Equal(3))
+	})
+
+	It("does not retry rejected requests", func() {
+		recv.statuses = []int{http.StatusBadRequest}
+		p := &Pusher{
+			Gatherer:   registry,
+			URL:        srv.URL,
+			Mode:       PushRemoteWrite,
+			MinBackoff: time.Millisecond,
+		}
+		Expect(p.pushWithRetry(context.Background())).To(MatchError(ContainSubstring("400")))
+		Expect(recv.count()).To(Equal(1))
+	})
+
+	It("gives up retrying when the context ends", func() {
+		recv.statuses = []int{500, 500, 500, 500, 500, 500, 500, 500}
+		p := &Pusher{
+			Gatherer:   registry,
+			URL:        srv.URL,
+			Mode:       PushRemoteWrite,
+			MinBackoff: 10 * time.Millisecond,
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		Expect(p.pushWithRetry(ctx)).NotTo(Succeed())
+		Expect(recv.count()).To(BeNumerically("<", 8))
+	})
+
+	It("pushes every interval until stopped", func() {
+		p := &Pusher{
+			Gatherer: registry,
+			URL:      srv.URL,
+			Interval: 10 * time.Millisecond,
+		}
+		stop := make(chan struct{})
+		done := make(chan error, 1)
+		go func() { done <- p.Start(stop) }()
+
+		Eventually(recv.count).Should(BeNumerically(">=", 3))
+		close(stop)
+		Eventually(done).Should(Receive(BeNil()))
+	})
+})
@@ -0,0 +1,212 @@
+/*
+Copyright 2020 The Operator-SDK Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+// Reconcile results counted by ReconcileMetrics. ReconcileNotFound is
+// counted per namespace, with an empty memcached label, since the object
+// it would name is gone.
+const (
+	ReconcileSuccess  = "success"
+	ReconcileError    = "error"
+	ReconcileRequeue  = "requeue"
+	ReconcileNotFound = "not_found"
+)
+
+// Reconcile phases timed by ReconcileMetrics.
+const (
+	PhaseFetch            = "fetch"
+	PhaseEnsureDeployment = "ensure_deployment"
+	PhaseScale            = "scale"
+	PhaseListPods         = "list_pods"
+	PhaseStatusUpdate     = "status_update"
+)
+
+// ReconcileMetrics counts the results of reconciling each Memcached and
+// times the phases of its reconciles. The series of an object are deleted
+// with it, and again by a reconcile that finds the object already gone, so
+// that reconcile does not bring them back. Samples carry the reconciled
+// object as an exemplar.
+type ReconcileMetrics struct {
+	results  *createdCounterVec
+	duration *prometheus.HistogramVec
+
+	mu sync.Mutex
+	// series holds, per object key, the label values of its series in
+	// results and duration.
+	series map[string]*reconcileSeries
+}
+
+type reconcileSeries struct {
+	namespace, name string
+	results         map[string]bool
+	phases          map[string]bool
+}
+
+// NewReconcileMetrics returns the memcached_reconcile_total and
+// memcached_reconcile_phase_duration_seconds families.
+func NewReconcileMetrics() *ReconcileMetrics {
+	return &ReconcileMetrics{
+		results: newCreatedCounterVec(prometheus.CounterOpts{
+			Name: "memcached_reconcile_total",
+			Help: "Number of reconciles of a Memcached by result.",
+		}, []string{"namespace", "memcached", "result"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "memcached_reconcile_phase_duration_seconds",
+			Help:    "Time spent in each phase of reconciling a Memcached.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+		}, []string{"namespace", "memcached", "phase"}),
+		series: map[string]*reconcileSeries{},
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (r *ReconcileMetrics) Describe(ch chan<- *prometheus.Desc) {
+	r.results.Describe(ch)
+	r.duration.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (r *ReconcileMetrics) Collect(ch chan<- prometheus.Metric) {
+	r.results.Collect(ch)
+	r.duration.Collect(ch)
+}
+
+// ObserveResult counts a reconcile of the named object, with obj as the
+// exemplar. A ReconcileNotFound result is counted for the namespace and
+// removes the series of the object. It does nothing on a nil
+// ReconcileMetrics.
+func (r *ReconcileMetrics) ObserveResult(namespace, name string, obj metav1.Object, result string) {
+	if r == nil {
+		return
+	}
+	if result == ReconcileNotFound {
+		r.forget(objectKey(namespace, name))
+		c, err := r.results.GetMetricWithLabelValues(namespace, "", result)
+		if err != nil {
+			RecordError("memcached_reconcile_total", err, "namespace", namespace, "name", name)
+			return
+		}
+		c.Inc()
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, err := r.results.GetMetricWithLabelValues(namespace, name, result)
+	if err != nil {
+		RecordError("memcached_reconcile_total", err, "namespace", namespace, "name", name)
+		return
+	}
+	AddWithExemplar(c, 1, Exemplar(obj))
+	r.objectSeries(namespace, name).results[result] = true
+}
+
+// StartPhase starts timing a phase of reconciling the named object. The
+// returned function records the time elapsed when called, with obj as it
+// is then as the exemplar. It does nothing on a nil ReconcileMetrics.
+func (r *ReconcileMetrics) StartPhase(namespace, name string, obj metav1.Object, phase string) func() {
+	if r == nil {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		o, err := r.duration.GetMetricWithLabelValues(namespace, name, phase)
+		if err != nil {
+			RecordError("memcached_reconcile_phase_duration_seconds", err, "namespace", namespace, "name", name)
+			return
+		}
+		ObserveWithExemplar(o, time.Since(start).Seconds(), Exemplar(obj))
+		r.objectSeries(namespace, name).phases[phase] = true
+	}
+}
+
+// objectSeries must be called with r.mu held.
+func (r *ReconcileMetrics) objectSeries(namespace, name string) *reconcileSeries {
+	key := objectKey(namespace, name)
+	s, ok := r.series[key]
+	if !ok {
+		s = &reconcileSeries{
+			namespace: namespace,
+			name:      name,
+			results:   map[string]bool{},
+			phases:    map[string]bool{},
+		}
+		r.series[key] = s
+	}
+	return s
+}
+
+// Delete removes the series of a deleted Memcached.
+func (r *ReconcileMetrics) Delete(e event.DeleteEvent) {
+	if _, ok := toMemcached(e.Object); ok {
+		r.forget(objectKey(e.Meta.GetNamespace(), e.Meta.GetName()))
+	}
+}
+
+// ResyncKinds implements KindedResyncHandler.
+func (r *ReconcileMetrics) ResyncKinds() []schema.GroupVersionKind {
+	return []schema.GroupVersionKind{memcachedGVK}
+}
+
+// Resync removes the series of Memcacheds missing from objs.
+func (r *ReconcileMetrics) Resync(objs []runtime.Object) {
+	seen := map[string]bool{}
+	for _, obj := range objs {
+		if m, ok := toMemcached(obj); ok {
+			seen[objectKey(m.Namespace, m.Name)] = true
+		}
+	}
+	r.mu.Lock()
+	var stale []string
+	for key := range r.series {
+		if !seen[key] {
+			stale = append(stale, key)
+		}
+	}
+	r.mu.Unlock()
+	for _, key := range stale {
+		r.forget(key)
+	}
+}
+
+func (r *ReconcileMetrics) forget(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.series[key]
+	if !ok {
+		return
+	}
+	for result := range s.results {
+		r.results.DeleteLabelValues(s.namespace, s.name, result)
+	}
+	for phase := range s.phases {
+		r.duration.DeleteLabelValues(s.namespace, s.name, phase)
+	}
+	delete(r.series, key)
+}
@@ -0,0 +1,177 @@
+/*
+Copyright 2020 The Operator-SDK Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	dto "github.com/prometheus/client_model/go"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+// resultCounts returns the memcached_reconcile_total counters keyed by
+// their name=value labels joined with commas.
+func resultCounts(registry RegistererGathererPredicater) map[string]float64 {
+	counts := map[string]float64{}
+	mf := gatheredFamily(registry, "memcached_reconcile_total")
+	if mf == nil {
+		return counts
+	}
+	for _, m := range mf.GetMetric() {
+		key := ""
+		for i, l := range m.GetLabel() {
+			if i > 0 {
+				key += ","
+			}
+			key += l.GetName() + "=" + l.GetValue()
+		}
+		counts[key] = m.GetCounter().GetValue()
+	}
+	return counts
+}
+
+// phaseCounts returns the number of observations of each phase.
+func phaseCounts(registry RegistererGathererPredicater) map[string]uint64 {
+	counts := map[string]uint64{}
+	mf := gatheredFamily(registry, "memcached_reconcile_phase_duration_seconds")
+	if mf == nil {
+		return counts
+	}
+	for _, m := range mf.GetMetric() {
+		for _, l := range m.GetLabel() {
+			if l.GetName() == "phase" {
+				counts[l.GetValue()] = m.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+	return counts
+}
+
+// exemplarLabels returns the labels of e by name.
+func exemplarLabels(e *dto.Exemplar) map[string]string {
+	labels := map[string]string{}
+	for _, l := range e.GetLabel() {
+		labels[l.GetName()] = l.GetValue()
+	}
+	return labels
+}
+
+var _ = Describe("ReconcileMetrics", func() {
+	var (
+		registry RegistererGathererPredicater
+		rm       *ReconcileMetrics
+	)
+
+	BeforeEach(func() {
+		registry = NewRegistry()
+		rm = NewReconcileMetrics()
+		registry.MustRegister(rm)
+	})
+
+	It("counts reconciles by result", func() {
+		rm.ObserveResult("default", "example", nil, ReconcileSuccess)
+		rm.ObserveResult("default", "example", nil, ReconcileSuccess)
+		rm.ObserveResult("default", "example", nil, ReconcileRequeue)
+
+		Expect(resultCounts(registry)).To(Equal(map[string]float64{
+			"memcached=example,namespace=default,result=success": 2,
+			"memcached=example,namespace=default,result=requeue": 1,
+		}))
+	})
+
+	It("times each phase when its done function is called", func() {
+		done := rm.StartPhase("default", "example", nil, PhaseFetch)
+		Expect(phaseCounts(registry)).To(BeEmpty())
+		done()
+		rm.StartPhase("default", "example", nil, PhaseScale)()
+
+		Expect(phaseCounts(registry)).To(Equal(map[string]uint64{
+			PhaseFetch: 1,
+			PhaseScale: 1,
+		}))
+	})
+
+	It("deletes the series of a deleted object", func() {
+		obj := newMemcached("example")
+		rm.ObserveResult("default", "example", nil, ReconcileError)
+		rm.StartPhase("default", "example", nil, PhaseFetch)()
+		rm.ObserveResult("default", "other", nil, ReconcileSuccess)
+
+		registry.Predicate().Delete(event.DeleteEvent{Meta: obj, Object: obj})
+
+		Expect(resultCounts(registry)).To(Equal(map[string]float64{
+			"memcached=other,namespace=default,result=success": 1,
+		}))
+		Expect(phaseCounts(registry)).To(BeEmpty())
+	})
+
+	It("removes the series of objects missing from a resync", func() {
+		obj := newMemcached("example")
+		rm.ObserveResult("default", "example", nil, ReconcileSuccess)
+		rm.ObserveResult("default", "gone", nil, ReconcileSuccess)
+
+		registry.Resync([]runtime.Object{obj})
+
+		Expect(resultCounts(registry)).To(Equal(map[string]float64{
+			"memcached=example,namespace=default,result=success": 1,
+		}))
+	})
+
+	It("leaves no series behind for a reconcile of a deleted object", func() {
+		obj := newMemcached("example")
+		rm.ObserveResult("default", "example", nil, ReconcileSuccess)
+		registry.Predicate().Delete(event.DeleteEvent{Meta: obj, Object: obj})
+
+		rm.StartPhase("default", "example", nil, PhaseFetch)()
+		rm.ObserveResult("default", "example", nil, ReconcileNotFound)
+		rm.ObserveResult("default", "other", nil, ReconcileNotFound)
+
+		Expect(resultCounts(registry)).To(Equal(map[string]float64{
+			"memcached=,namespace=default,result=not_found": 2,
+		}))
+		Expect(phaseCounts(registry)).To(BeEmpty())
+	})
+
+	It("attaches the reconciled object as an exemplar", func() {
+		obj := newMemcached("example")
+		done := rm.StartPhase("default", "example", obj, PhaseFetch)
+		obj.UID = "1234"
+		obj.ResourceVersion = "7"
+		done()
+		rm.ObserveResult("default", "example", obj, ReconcileSuccess)
+
+		want := map[string]string{"uid": "1234", "resource_version": "7"}
+		counter := gatheredFamily(registry, "memcached_reconcile_total").GetMetric()[0].GetCounter()
+		Expect(exemplarLabels(counter.GetExemplar())).To(Equal(want))
+		var exemplars []map[string]string
+		for _, b := range gatheredFamily(registry, "memcached_reconcile_phase_duration_seconds").GetMetric()[0].GetHistogram().GetBucket() {
+			if b.GetExemplar() != nil {
+				exemplars = append(exemplars, exemplarLabels(b.GetExemplar()))
+			}
+		}
+		Expect(exemplars).To(Equal([]map[string]string{want}))
+	})
+
+	It("does nothing when nil", func() {
+		var nilMetrics *ReconcileMetrics
+		Expect(func() {
+			nilMetrics.ObserveResult("default", "example", nil, ReconcileSuccess)
+			nilMetrics.StartPhase("default", "example", nil, PhaseFetch)()
+		}).NotTo(Panic())
+	})
+})
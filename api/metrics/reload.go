@@ -0,0 +1,222 @@
+/*
+Copyright 2020 The Operator-SDK Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+const defaultReloadInterval = 10 * time.Second
+
+// ConfigReloader keeps the families registered in a Registry in sync with a
+// metrics configuration file. Families that were removed or changed are
+// unregistered, new ones are registered, and unchanged ones keep their
+// series. Mounted ConfigMaps are updated by the kubelet through a symlink
+// swap, so the file is polled rather than watched.
+//
+// Prometheus fixes the help text and label names of a metric name for the
+// lifetime of the process, so a configuration that changes them for a
+// family registered earlier is rejected until the operator restarts.
+type ConfigReloader struct {
+	// Path is the metrics configuration file.
+	Path string
+	// Registry receives the generated collectors.
+	Registry prometheus.Registerer
+	// Scheme resolves the kind of typed objects without TypeMeta.
+	Scheme *runtime.Scheme
+	// Reader, when set, is used to seed newly registered families with the
+	// objects that already exist instead of waiting for the next event.
+	Reader client.Reader
+	// Interval is how often the file is checked for changes. Defaults to
+	// 10 seconds.
+	Interval time.Duration
+	// WatchedKinds, when set, are the kinds whose events reach Registry.
+	// A configuration with families for any other kind is rejected.
+	WatchedKinds []schema.GroupVersionKind
+
+	mu       sync.Mutex
+	data     []byte
+	families map[string]*FamilyCollector
+	// descs holds the descriptors each family name was first registered
+	// with.
+	descs map[string]string
+}
+
+// Load reads the configuration file and applies it if it changed since the
+// last call. An invalid configuration leaves the registered families as
+// they were and is not retried until the file changes again.
+func (r *ConfigReloader) Load() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data, err := ioutil.ReadFile(r.Path)
+	if err != nil {
+		return err
+	}
+	if r.data != nil && bytes.Equal(data, r.data) {
+		return nil
+	}
+	r.data = data
+
+	cfg, err := ParseConfig(data)
+	if err != nil {
+		return err
+	}
+	collectors, err := cfg.Collectors(r.Scheme)
+	if err != nil {
+		return err
+	}
+	if r.WatchedKinds != nil {
+		if err := cfg.CheckKinds(r.WatchedKinds); err != nil {
+			return err
+		}
+	}
+	return r.apply(collectors)
+}
+
+// apply swaps the registered families for collectors. If any new family
+// fails to register, the previous set is restored.
+func (r *ConfigReloader) apply(collectors []*FamilyCollector) error {
+	next := make(map[string]*FamilyCollector, len(collectors))
+	var added, removed []*FamilyCollector
+	for _, c := range collectors {
+		name := c.Config().Name
+		if old, ok := r.families[name]; ok && reflect.DeepEqual(old.Config(), c.Config()) {
+			next[name] = old
+			continue
+		}
+		next[name] = c
+		added = append(added, c)
+	}
+	for name, old := range r.families {
+		if next[name] != old {
+			removed = append(removed, old)
+		}
+	}
+	for _, c := range added {
+		name := c.Config().Name
+		if desc, ok := r.descs[name]; ok && desc != collectorDescs(c) {
+			return fmt.Errorf("metric family %q: help and labels cannot change until the operator restarts", name)
+		}
+	}
+
+	for _, c := range removed {
+		r.Registry.Unregister(c)
+	}
+	for i, c := range added {
+		if err := r.Registry.Register(c); err != nil {
+			for _, c := range added[:i] {
+				r.Registry.Unregister(c)
+			}
+			for _, c := range removed {
+				if err := r.Registry.Register(c); err != nil {
+					log.Error(err, "unable to restore metric family", "metric", c.Config().Name)
+				}
+			}
+			return fmt.Errorf("metric family %q: %v", c.Config().Name, err)
+		}
+	}
+
+	r.families = next
+	if r.descs == nil {
+		r.descs = map[string]string{}
+	}
+	for _, c := range added {
+		r.descs[c.Config().Name] = collectorDescs(c)
+		r.seed(c)
+	}
+	if len(added) > 0 || len(removed) > 0 {
+		log.Info("metrics config applied", "path", r.Path, "added", len(added), "removed", len(removed))
+	}
+	return nil
+}
+
+// collectorDescs returns the descriptors of c, help and labels included,
+// in a comparable form.
+func collectorDescs(c prometheus.Collector) string {
+	descs := make(chan *prometheus.Desc)
+	go func() {
+		c.Describe(descs)
+		close(descs)
+	}()
+	var s []string
+	for d := range descs {
+		s = append(s, d.String())
+	}
+	sort.Strings(s)
+	return strings.Join(s, "\n")
+}
+
+// seed replays the existing objects of the family's kind as create events.
+func (r *ConfigReloader) seed(c *FamilyCollector) {
+	gvk := c.Config().GroupVersionKind
+	if r.Reader == nil || gvk == nil {
+		return
+	}
+	list := &unstructured.UnstructuredList{}
+	list.SetAPIVersion(c.gvk.GroupVersion().String())
+	list.SetKind(gvk.Kind + "List")
+	if err := r.Reader.List(context.TODO(), list); err != nil {
+		log.Error(err, "unable to seed metric family", "metric", c.Config().Name)
+		return
+	}
+	for i := range list.Items {
+		obj := &list.Items[i]
+		c.Create(event.CreateEvent{Meta: obj, Object: obj})
+	}
+}
+
+// NeedLeaderElection lets every replica keep its registry up to date.
+func (r *ConfigReloader) NeedLeaderElection() bool {
+	return false
+}
+
+// Start polls the configuration file until stop is closed.
+func (r *ConfigReloader) Start(stop <-chan struct{}) error {
+	interval := r.Interval
+	if interval <= 0 {
+		interval = defaultReloadInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+			if err := r.Load(); err != nil {
+				log.Error(err, "unable to reload metrics config", "path", r.Path)
+			}
+		}
+	}
+}
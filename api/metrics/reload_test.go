@@ -0,0 +1,185 @@
+/*
+Copyright 2020 The Operator-SDK Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+const teamInfoConfig = `
+metrics:
+- name: team_info
+  type: info
+  help: Team of a custom resource.
+  labels:
+  - name: name
+    path: .metadata.name
+  - name: team
+    path: .metadata.labels.team
+`
+
+var _ = Describe("ConfigReloader", func() {
+	var (
+		dir      string
+		registry RegistererGathererPredicater
+		reloader *ConfigReloader
+	)
+
+	write := func(content string) {
+		Expect(ioutil.WriteFile(reloader.Path, []byte(content), 0644)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "metrics-config")
+		Expect(err).NotTo(HaveOccurred())
+		registry = NewRegistry()
+		reloader = &ConfigReloader{
+			Path:     filepath.Join(dir, "config.yaml"),
+			Registry: registry,
+		}
+		write(teamInfoConfig)
+		Expect(reloader.Load()).To(Succeed())
+
+		obj := newMemcached("example")
+		obj.Labels = map[string]string{"team": "cache"}
+		registry.Predicate().Create(event.CreateEvent{Meta: obj, Object: obj})
+		Expect(familySeries(registry, "team_info")).To(HaveLen(1))
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("keeps the series of unchanged families", func() {
+		write(teamInfoConfig + `
+- name: size
+  type: gauge
+  labels:
+  - name: name
+    path: .metadata.name
+  value: .spec.size
+`)
+		Expect(reloader.Load()).To(Succeed())
+
+		Expect(familySeries(registry, "team_info")).To(Equal(map[string]float64{"name=example,team=cache": 1}))
+		Expect(gatheredFamily(registry, "size")).To(BeNil())
+	})
+
+	It("swaps changed families for new ones", func() {
+		write(`
+metrics:
+- name: team_info
+  type: info
+  help: Team of a custom resource.
+  labels:
+  - name: name
+    path: .metadata.name
+  - name: team
+    path: .metadata.annotations.team
+`)
+		Expect(reloader.Load()).To(Succeed())
+
+		Expect(gatheredFamily(registry, "team_info")).To(BeNil())
+		obj := newMemcached("example")
+		obj.Annotations = map[string]string{"team": "storage"}
+		registry.Predicate().Create(event.CreateEvent{Meta: obj, Object: obj})
+		Expect(familySeries(registry, "team_info")).To(Equal(map[string]float64{"name=example,team=storage": 1}))
+	})
+
+	It("rejects changes to the help or labels of a family", func() {
+		write(`
+metrics:
+- name: team_info
+  type: info
+  help: Owning team of a custom resource.
+  labels:
+  - name: team
+    path: .metadata.labels.team
+`)
+		Expect(reloader.Load()).To(MatchError(ContainSubstring("cannot change until the operator restarts")))
+
+		mf := gatheredFamily(registry, "team_info")
+		Expect(mf.GetHelp()).To(Equal("Team of a custom resource."))
+		Expect(familySeries(registry, "team_info")).To(Equal(map[string]float64{"name=example,team=cache": 1}))
+	})
+
+	It("unregisters removed families", func() {
+		write("metrics: []\n")
+		Expect(reloader.Load()).To(Succeed())
+
+		Expect(gatheredFamily(registry, "team_info")).To(BeNil())
+	})
+
+	It("restores the previous families when a new one fails to register", func() {
+		taken := prometheus.NewGauge(prometheus.GaugeOpts{Name: "taken", Help: "Registered outside the config."})
+		registry.MustRegister(taken)
+		write(`
+metrics:
+- name: team_info
+  type: info
+  help: Team of a custom resource.
+  labels:
+  - name: name
+    path: .metadata.name
+  - name: team
+    path: .metadata.annotations.team
+- name: taken
+  type: info
+`)
+		Expect(reloader.Load()).To(MatchError(ContainSubstring(`"taken"`)))
+
+		mf := gatheredFamily(registry, "team_info")
+		Expect(mf.GetHelp()).To(Equal("Team of a custom resource."))
+		Expect(familySeries(registry, "team_info")).To(Equal(map[string]float64{"name=example,team=cache": 1}))
+	})
+
+	It("leaves the families in place when the file is invalid", func() {
+		write("metrics: [")
+		Expect(reloader.Load()).NotTo(Succeed())
+
+		write(`
+metrics:
+- name: team_info
+  type: histogram
+`)
+		Expect(reloader.Load()).NotTo(Succeed())
+
+		Expect(familySeries(registry, "team_info")).To(Equal(map[string]float64{"name=example,team=cache": 1}))
+	})
+
+	It("rejects families for kinds that are not watched", func() {
+		reloader.WatchedKinds = []schema.GroupVersionKind{{Group: "cache.example.com", Version: "v1alpha1", Kind: "Memcached"}}
+		write(teamInfoConfig + `
+- name: redis_info
+  type: info
+  groupVersionKind: {group: cache.example.com, version: v1alpha1, kind: Redis}
+`)
+		Expect(reloader.Load()).To(MatchError(ContainSubstring("not watched")))
+
+		Expect(gatheredFamily(registry, "redis_info")).To(BeNil())
+		Expect(familySeries(registry, "team_info")).To(HaveLen(1))
+	})
+})
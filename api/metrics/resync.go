@@ -0,0 +1,291 @@
+/*
+Copyright 2020 The Operator-SDK Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+)
+
+const (
+	defaultResyncInterval = 5 * time.Minute
+	defaultResyncTimeout  = time.Minute
+	// resyncRetryInterval is the time between resyncs while the registry
+	// is not yet ready.
+	resyncRetryInterval = 10 * time.Second
+)
+
+// ResyncHandler is implemented by collectors that can rebuild their series
+// from the complete list of current objects. Series for objects missing from
+// the list must be deleted.
+//
+// The list is taken before Resync is called and events keep being
+// dispatched meanwhile, so series are only eventually consistent: an object
+// created after the list loses its series, and one deleted after it gets
+// them back, until its next event or the next resync.
+type ResyncHandler interface {
+	Resync(objs []runtime.Object)
+}
+
+// KindedResyncHandler is implemented by ResyncHandlers that only keep series
+// for objects of the kinds returned by ResyncKinds. They are resynced as
+// soon as those kinds are listed, even if other kinds could not be.
+// Handlers returning no kinds are only resynced when every kind is listed.
+type KindedResyncHandler interface {
+	ResyncHandler
+	ResyncKinds() []schema.GroupVersionKind
+}
+
+// Resync passes the complete list of current objects, of every watched
+// kind, to each registered ResyncHandler.
+func (r *Registry) Resync(objs []runtime.Object) {
+	for _, m := range r.loadHandlers().resync {
+		c := m.collector.(ResyncHandler)
+		r.instrument(m.name, resyncEvent, nil, func() { c.Resync(objs) })
+	}
+}
+
+// ResyncKinds passes the current objects of the listed kinds to each
+// registered KindedResyncHandler whose kinds were all listed. Other
+// handlers are left alone, since objects of the kinds missing from the
+// list would look deleted to them.
+func (r *Registry) ResyncKinds(listed []schema.GroupVersionKind, objs []runtime.Object) {
+	ok := make(map[schema.GroupVersionKind]bool, len(listed))
+	for _, gvk := range listed {
+		ok[gvk] = true
+	}
+	for _, m := range r.loadHandlers().resync {
+		c, kinded := m.collector.(KindedResyncHandler)
+		if !kinded || !coversKinds(ok, c.ResyncKinds()) {
+			continue
+		}
+		r.instrument(m.name, resyncEvent, nil, func() { c.Resync(objs) })
+	}
+}
+
+func coversKinds(listed map[schema.GroupVersionKind]bool, kinds []schema.GroupVersionKind) bool {
+	if len(kinds) == 0 {
+		return false
+	}
+	for _, gvk := range kinds {
+		if !listed[gvk] {
+			return false
+		}
+	}
+	return true
+}
+
+// Resyncer periodically lists the watched kinds from the cache and resyncs
+// the registry with them. This recomputes every series and removes series
+// for objects deleted while the operator was not running.
+//
+// Each kind is listed on its own with a timeout, so a kind that cannot be
+// listed, for lack of RBAC or of its CRD, only holds back the resync of
+// the collectors that depend on it.
+type Resyncer struct {
+	// Cache is read for the current objects, usually the manager's cache.
+	Cache cache.Cache
+	// Scheme decides whether a kind is listed as a typed or an
+	// unstructured object, so typed kinds share the informer their
+	// controllers already use.
+	Scheme *runtime.Scheme
+	// GroupVersionKinds are the kinds to list. Ready fails until each of
+	// them has been listed once.
+	GroupVersionKinds []schema.GroupVersionKind
+	// ExtraGroupVersionKinds are listed like GroupVersionKinds but do not
+	// hold back Ready.
+	ExtraGroupVersionKinds []schema.GroupVersionKind
+	// Registry is resynced with the listed objects.
+	Registry RegistererGathererPredicater
+	// Interval is the time between resyncs. Defaults to 5 minutes.
+	Interval time.Duration
+	// Timeout bounds the listing of each kind, including the wait for its
+	// informer to sync. Defaults to 1 minute.
+	Timeout time.Duration
+
+	mu     sync.Mutex
+	listed map[schema.GroupVersionKind]bool
+}
+
+// NeedLeaderElection lets every replica populate its registry, so
+// non-leaders serve metrics and report ready too.
+func (r *Resyncer) NeedLeaderElection() bool {
+	return false
+}
+
+// Ready returns an error until every kind in GroupVersionKinds has been
+// listed and resynced once.
+func (r *Resyncer) Ready() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, gvk := range r.GroupVersionKinds {
+		if !r.listed[gvk] {
+			return fmt.Errorf("metrics for %s have not been populated yet", gvk)
+		}
+	}
+	return nil
+}
+
+// Start resyncs right away, then every Interval until stop is closed. Until
+// Ready succeeds, failed resyncs are retried sooner.
+func (r *Resyncer) Start(stop <-chan struct{}) error {
+	interval := r.Interval
+	if interval <= 0 {
+		interval = defaultResyncInterval
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	for {
+		if err := r.Resync(ctx); err != nil {
+			log.Error(err, "unable to resync metrics")
+		}
+		wait := interval
+		if r.Ready() != nil && resyncRetryInterval < wait {
+			wait = resyncRetryInterval
+		}
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Resync lists every watched kind and resyncs the registry. When some kinds
+// cannot be listed, only the collectors that do not depend on them are
+// resynced, since a partial list would delete the series of the missing
+// objects. The errors of every failed kind are returned.
+func (r *Resyncer) Resync(ctx context.Context) error {
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = defaultResyncTimeout
+	}
+	var (
+		objs   []runtime.Object
+		listed []schema.GroupVersionKind
+		errs   []string
+	)
+	kinds := append(append([]schema.GroupVersionKind(nil), r.GroupVersionKinds...), r.ExtraGroupVersionKinds...)
+	for _, gvk := range kinds {
+		listCtx, cancel := context.WithTimeout(ctx, timeout)
+		items, err := r.list(listCtx, gvk)
+		cancel()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("unable to list %s: %v", gvk, err))
+			continue
+		}
+		objs = append(objs, items...)
+		listed = append(listed, gvk)
+	}
+	if len(errs) == 0 {
+		r.Registry.Resync(objs)
+	} else {
+		r.Registry.ResyncKinds(listed, objs)
+	}
+
+	r.mu.Lock()
+	if r.listed == nil {
+		r.listed = map[schema.GroupVersionKind]bool{}
+	}
+	for _, gvk := range listed {
+		r.listed[gvk] = true
+	}
+	r.mu.Unlock()
+	log.V(1).Info("metrics resynced", "objects", len(objs), "kinds", len(listed))
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (r *Resyncer) list(ctx context.Context, gvk schema.GroupVersionKind) ([]runtime.Object, error) {
+	listGVK := gvk.GroupVersion().WithKind(gvk.Kind + "List")
+	var list runtime.Object
+	if r.Scheme != nil && r.Scheme.Recognizes(listGVK) {
+		var err error
+		if list, err = r.Scheme.New(listGVK); err != nil {
+			return nil, err
+		}
+	} else {
+		u := &unstructured.UnstructuredList{}
+		u.SetGroupVersionKind(listGVK)
+		list = u
+	}
+	if err := r.Cache.List(ctx, list); err != nil {
+		return nil, err
+	}
+	return meta.ExtractList(list)
+}
+
+// gaugeVecSeries returns the label sets of every series currently in vec.
+func gaugeVecSeries(vec *prometheus.GaugeVec) []map[string]string {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		vec.Collect(ch)
+		close(ch)
+	}()
+	var series []map[string]string
+	for m := range ch {
+		d := &dto.Metric{}
+		if err := m.Write(d); err != nil {
+			continue
+		}
+		labels := make(map[string]string, len(d.GetLabel()))
+		for _, l := range d.GetLabel() {
+			labels[l.GetName()] = l.GetValue()
+		}
+		series = append(series, labels)
+	}
+	return series
+}
+
+// pruneGaugeVec deletes every series of vec for which keep returns false.
+func pruneGaugeVec(vec *prometheus.GaugeVec, keep func(labels map[string]string) bool) {
+	for _, labels := range gaugeVecSeries(vec) {
+		if !keep(labels) {
+			vec.Delete(labels)
+		}
+	}
+}
+
+// memcachedKeys returns the namespace/name keys of the Memcacheds in objs.
+func memcachedKeys(objs []runtime.Object) map[string]bool {
+	keys := map[string]bool{}
+	for _, obj := range objs {
+		if m, ok := toMemcached(obj); ok {
+			keys[objectKey(m.Namespace, m.Name)] = true
+		}
+	}
+	return keys
+}
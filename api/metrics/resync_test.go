@@ -0,0 +1,221 @@
+/*
+Copyright 2020 The Operator-SDK Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	cachev1alpha1 "github.com/bharathi-tenneti/memcached-operator-metrics/api/v1alpha1"
+)
+
+var _ = Describe("Registry.Resync", func() {
+	var (
+		registry RegistererGathererPredicater
+		family   *FamilyCollector
+		crInfo   *CRInfoGauge
+		timeInfo *TimeInfo
+	)
+
+	BeforeEach(func() {
+		var err error
+		registry = NewRegistry()
+		family, err = NewFamilyCollector(FamilyConfig{
+			Name:   "memcached_spec_size",
+			Type:   MetricTypeGauge,
+			Labels: []LabelConfig{{Name: "name", Path: ".metadata.name"}},
+			Value:  ".spec.size",
+		})
+		Expect(err).NotTo(HaveOccurred())
+		crInfo = NewCRInfoGauge()
+		timeInfo = NewTimeInfo(TimeInfoOptions{LegacySizeInfo: true})
+		registry.MustRegister(family, crInfo, timeInfo)
+	})
+
+	It("rebuilds series for current objects and deletes stale ones", func() {
+		gone := newMemcached("gone")
+		kept := newMemcached("kept")
+		kept.Spec.Size = 1
+		for _, obj := range []runtime.Object{gone, kept} {
+			o := obj.(*cachev1alpha1.Memcached)
+			registry.Predicate().Create(event.CreateEvent{Meta: o, Object: o})
+			timeInfo.SetLastReconcile(o.Namespace, o.Name)
+		}
+
+		updated := kept.DeepCopy()
+		updated.Spec.Size = 3
+		added := newMemcached("added")
+		registry.Resync([]runtime.Object{updated, added})
+
+		sizes := gatheredFamily(registry, "memcached_spec_size").GetMetric()
+		Expect(sizes).To(HaveLen(2))
+		values := map[string]float64{}
+		for _, m := range sizes {
+			values[m.GetLabel()[0].GetValue()] = m.GetGauge().GetValue()
+		}
+		Expect(values).To(Equal(map[string]float64{"kept": 3, "added": 0}))
+
+		Expect(gatheredFamily(registry, "custom_resource_info").GetMetric()).To(HaveLen(2))
+		Expect(gatheredFamily(registry, "memcached_last_reconcile_timestamp_seconds").GetMetric()).To(HaveLen(1))
+		Expect(gatheredFamily(registry, "size_info").GetMetric()).To(HaveLen(1))
+	})
+
+	It("clears every series when no objects remain", func() {
+		obj := newMemcached("example")
+		registry.Predicate().Create(event.CreateEvent{Meta: obj, Object: obj})
+
+		registry.Resync(nil)
+		Expect(gatheredNames(registry)).To(BeEmpty())
+	})
+})
+
+// listCache is a cache.Cache that only lists. Kinds in items are listed,
+// kinds in errs fail, and any other kind blocks until the context is done
+// like an informer that never syncs.
+type listCache struct {
+	cache.Cache
+	scheme *runtime.Scheme
+	items  map[schema.GroupVersionKind][]runtime.Object
+	errs   map[schema.GroupVersionKind]error
+}
+
+func (c *listCache) List(ctx context.Context, list runtime.Object, _ ...client.ListOption) error {
+	gvk, err := apiutil.GVKForObject(list, c.scheme)
+	if err != nil {
+		return err
+	}
+	gvk.Kind = strings.TrimSuffix(gvk.Kind, "List")
+	if err := c.errs[gvk]; err != nil {
+		return err
+	}
+	items, ok := c.items[gvk]
+	if !ok {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return meta.SetList(list, items)
+}
+
+var _ = Describe("Resyncer", func() {
+	widget := schema.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Widget"}
+	gadget := schema.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Gadget"}
+
+	var (
+		registry RegistererGathererPredicater
+		scheme   *runtime.Scheme
+		c        *listCache
+		resyncer *Resyncer
+	)
+
+	newWidget := func(name string) *unstructured.Unstructured {
+		obj := &unstructured.Unstructured{}
+		obj.SetGroupVersionKind(widget)
+		obj.SetNamespace("default")
+		obj.SetName(name)
+		return obj
+	}
+
+	BeforeEach(func() {
+		registry = NewRegistry()
+		registry.MustRegister(NewMemcachedCollector(MemcachedCollectorOptions{}))
+		widgets, err := NewFamilyCollector(FamilyConfig{
+			Name:             "widget_info",
+			Type:             MetricTypeInfo,
+			GroupVersionKind: &GroupVersionKind{Group: widget.Group, Version: widget.Version, Kind: widget.Kind},
+			Labels:           []LabelConfig{{Name: "name", Path: ".metadata.name"}},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		registry.MustRegister(widgets)
+
+		scheme = runtime.NewScheme()
+		Expect(cachev1alpha1.AddToScheme(scheme)).To(Succeed())
+		c = &listCache{scheme: scheme, items: map[schema.GroupVersionKind][]runtime.Object{}, errs: map[schema.GroupVersionKind]error{}}
+		resyncer = &Resyncer{
+			Cache:                  c,
+			Scheme:                 scheme,
+			GroupVersionKinds:      []schema.GroupVersionKind{memcachedGVK},
+			ExtraGroupVersionKinds: []schema.GroupVersionKind{widget},
+			Registry:               registry,
+			Timeout:                50 * time.Millisecond,
+		}
+
+		for _, name := range []string{"kept", "gone"} {
+			m := newMemcached(name)
+			registry.Predicate().Create(event.CreateEvent{Meta: m, Object: m})
+			w := newWidget(name)
+			registry.Predicate().Create(event.CreateEvent{Meta: w, Object: w})
+		}
+	})
+
+	It("resyncs every collector when every kind is listed", func() {
+		c.items[memcachedGVK] = []runtime.Object{newMemcached("kept")}
+		c.items[widget] = []runtime.Object{newWidget("kept")}
+
+		Expect(resyncer.Resync(context.Background())).To(Succeed())
+		Expect(familySeries(registry, "memcached_spec_size")).To(HaveLen(1))
+		Expect(familySeries(registry, "widget_info")).To(Equal(map[string]float64{"name=kept": 1}))
+		Expect(resyncer.Ready()).To(Succeed())
+	})
+
+	It("resyncs the collectors of the kinds that could be listed", func() {
+		c.items[memcachedGVK] = []runtime.Object{newMemcached("kept")}
+		c.errs[widget] = fmt.Errorf("no matches for kind Widget")
+
+		Expect(resyncer.Resync(context.Background())).To(MatchError(ContainSubstring("Widget")))
+		Expect(familySeries(registry, "memcached_spec_size")).To(HaveLen(1))
+		Expect(familySeries(registry, "widget_info")).To(HaveLen(2))
+		Expect(resyncer.Ready()).To(Succeed())
+	})
+
+	It("gives up on kinds whose informer does not sync", func() {
+		c.items[memcachedGVK] = []runtime.Object{newMemcached("kept")}
+
+		done := make(chan error)
+		go func() { done <- resyncer.Resync(context.Background()) }()
+		Eventually(done).Should(Receive(MatchError(ContainSubstring("Widget"))))
+		Expect(familySeries(registry, "memcached_spec_size")).To(HaveLen(1))
+		Expect(resyncer.Ready()).To(Succeed())
+	})
+
+	It("is not ready until each of its kinds has been listed", func() {
+		resyncer.GroupVersionKinds = append(resyncer.GroupVersionKinds, gadget)
+		c.items[memcachedGVK] = nil
+		c.items[widget] = nil
+		c.errs[gadget] = fmt.Errorf("forbidden")
+
+		Expect(resyncer.Resync(context.Background())).NotTo(Succeed())
+		Expect(resyncer.Ready()).To(MatchError(ContainSubstring("Gadget")))
+
+		delete(c.errs, gadget)
+		c.items[gadget] = nil
+		Expect(resyncer.Resync(context.Background())).To(Succeed())
+		Expect(resyncer.Ready()).To(Succeed())
+	})
+})
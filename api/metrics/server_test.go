@@ -0,0 +1,450 @@
+/*
+Copyright 2020 The Operator-SDK Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+// freeAddress returns a local address that was free when it was checked.
+func freeAddress() string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).NotTo(HaveOccurred())
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// writeCertificate writes a self-signed certificate for 127.0.0.1 with the
+// given serial number to dir.
+func writeCertificate(dir string, serial int64) (certFile, keyFile string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	Expect(err).NotTo(HaveOccurred())
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "metrics"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	Expect(err).NotTo(HaveOccurred())
+
+	certFile, keyFile = filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	Expect(ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)).To(Succeed())
+	Expect(ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{
+		Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key),
+	}), 0600)).To(Succeed())
+	return certFile, keyFile
+}
+
+var _ = Describe("Server TLS", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "metrics-tls")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("serves HTTPS with the configured certificate", func() {
+		certFile, keyFile := writeCertificate(dir, 1)
+		addr := freeAddress()
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			defer GinkgoRecover()
+			Expect((&Server{
+				Gatherer:      NewRegistry(),
+				ListenAddress: addr,
+				CertFile:      certFile,
+				KeyFile:       keyFile,
+			}).Start(stop)).To(Succeed())
+		}()
+
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}}
+		var resp *http.Response
+		Eventually(func() error {
+			var err error
+			resp, err = client.Get("https://" + addr + metricsPath)
+			return err
+		}).Should(Succeed())
+		defer resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.TLS.PeerCertificates[0].SerialNumber.Int64()).To(Equal(int64(1)))
+	})
+
+	It("reloads the certificate when the files change", func() {
+		certFile, keyFile := writeCertificate(dir, 1)
+		certs, err := newCertificateReloader(certFile, keyFile)
+		Expect(err).NotTo(HaveOccurred())
+
+		// Make sure the modification time moves even on coarse filesystems.
+		writeCertificate(dir, 2)
+		later := time.Now().Add(time.Minute)
+		Expect(os.Chtimes(certFile, later, later)).To(Succeed())
+
+		reloaded, err := certs.reload()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reloaded).To(BeTrue())
+		cert, err := certs.GetCertificate(nil)
+		Expect(err).NotTo(HaveOccurred())
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(leaf.SerialNumber.Int64()).To(Equal(int64(2)))
+	})
+
+	It("requires client certificates signed by the client CA", func() {
+		certFile, keyFile := writeCertificate(dir, 1)
+		s := &Server{CertFile: certFile, KeyFile: keyFile, ClientCAFile: certFile}
+		cfg, _, err := s.tlsConfig()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.ClientAuth).To(Equal(tls.RequireAndVerifyClientCert))
+	})
+
+	It("rejects a client CA without a serving certificate", func() {
+		_, _, err := (&Server{ClientCAFile: "ca.crt"}).tlsConfig()
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("TokenAuthenticator", func() {
+	var (
+		client  *fake.Clientset
+		reviews int
+		auth    *TokenAuthenticator
+		handler http.Handler
+	)
+
+	serve := func(token string) int {
+		req := httptest.NewRequest("GET", metricsPath, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	BeforeEach(func() {
+		reviews = 0
+		client = fake.NewSimpleClientset()
+		client.PrependReactor("create", "tokenreviews", func(a clienttesting.Action) (bool, runtime.Object, error) {
+			reviews++
+			tr := a.(clienttesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+			tr.Status.Authenticated = tr.Spec.Token != "invalid"
+			tr.Status.User.Username = tr.Spec.Token
+			return true, tr, nil
+		})
+		client.PrependReactor("create", "subjectaccessreviews", func(a clienttesting.Action) (bool, runtime.Object, error) {
+			sar := a.(clienttesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+			sar.Status.Allowed = sar.Spec.User == "prometheus" &&
+				sar.Spec.NonResourceAttributes.Path == metricsPath &&
+				sar.Spec.NonResourceAttributes.Verb == "get"
+			return true, sar, nil
+		})
+		auth = &TokenAuthenticator{Client: client}
+		handler = auth.Wrap(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+	})
+
+	It("rejects requests without a bearer token", func() {
+		Expect(serve("")).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("rejects unauthenticated tokens", func() {
+		Expect(serve("invalid")).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("rejects authenticated but unauthorized users", func() {
+		Expect(serve("someone")).To(Equal(http.StatusForbidden))
+	})
+
+	It("passes authorized requests and caches the decision", func() {
+		Expect(serve("prometheus")).To(Equal(http.StatusOK))
+		Expect(serve("prometheus")).To(Equal(http.StatusOK))
+		Expect(reviews).To(Equal(1))
+	})
+})
+
+var _ = Describe("Server endpoints", func() {
+	var (
+		addr  string
+		stop  chan struct{}
+		ready error
+	)
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get("http://" + addr + path)
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		return resp.StatusCode, string(body)
+	}
+
+	BeforeEach(func() {
+		registry := NewRegistry()
+		registry.MustRegister(NewCRInfoGauge())
+		obj := newMemcached("example")
+		obj.UID, obj.ResourceVersion = "4f0c5c2a-7d6e-4a53-9d3c-1f1f7a0d4c11", "42"
+		registry.Predicate().Create(event.CreateEvent{Meta: obj, Object: obj})
+
+		addr = freeAddress()
+		stop = make(chan struct{})
+		ready = fmt.Errorf("not synced")
+		s := &Server{
+			Gatherer:      registry,
+			ListenAddress: addr,
+			Ready:         func() error { return ready },
+		}
+		go func() {
+			defer GinkgoRecover()
+			Expect(s.Start(stop)).To(Succeed())
+		}()
+		Eventually(func() error {
+			_, err := http.Get("http://" + addr + healthzPath)
+			return err
+		}).Should(Succeed())
+	})
+
+	AfterEach(func() {
+		close(stop)
+	})
+
+	It("reports healthy", func() {
+		code, _ := get(healthzPath)
+		Expect(code).To(Equal(http.StatusOK))
+	})
+
+	It("reports ready only once the readiness check passes", func() {
+		code, body := get(readyzPath)
+		Expect(code).To(Equal(http.StatusServiceUnavailable))
+		Expect(body).To(ContainSubstring("not synced"))
+
+		ready = nil
+		code, _ = get(readyzPath)
+		Expect(code).To(Equal(http.StatusOK))
+	})
+
+	It("serves OpenMetrics with exemplars to scrapers that accept it", func() {
+		req, err := http.NewRequest(http.MethodGet, "http://"+addr+metricsPath, nil)
+		Expect(err).NotTo(HaveOccurred())
+		req.Header.Set("Accept", "application/openmetrics-text; version=0.0.1")
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(resp.Header.Get("Content-Type")).To(HavePrefix("application/openmetrics-text"))
+		Expect(string(body)).To(HaveSuffix("# EOF\n"))
+		Expect(string(body)).To(MatchRegexp(
+			`metrics_handler_duration_seconds_bucket\{collector="custom_resource_info",event="create",le="[^"]+"\} 1 # \{[^}]*` +
+				`uid="4f0c5c2a-7d6e-4a53-9d3c-1f1f7a0d4c11"[^}]*\}`))
+		Expect(string(body)).To(ContainSubstring(`resource_version="42"`))
+	})
+
+	It("serves the text format without exemplars by default", func() {
+		code, body := get(metricsPath)
+		Expect(code).To(Equal(http.StatusOK))
+		Expect(body).To(ContainSubstring("custom_resource_info"))
+		Expect(body).NotTo(ContainSubstring("# {"))
+	})
+
+	It("compresses responses for scrapers that accept gzip", func() {
+		req, err := http.NewRequest(http.MethodGet, "http://"+addr+metricsPath, nil)
+		Expect(err).NotTo(HaveOccurred())
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		Expect(resp.Header.Get("Content-Encoding")).To(Equal("gzip"))
+
+		zr, err := gzip.NewReader(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		body, err := ioutil.ReadAll(zr)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(body)).To(ContainSubstring("custom_resource_info"))
+	})
+
+	It("describes the registered collectors", func() {
+		code, body := get(collectorsPath)
+		Expect(code).To(Equal(http.StatusOK))
+
+		var infos []CollectorInfo
+		Expect(json.Unmarshal([]byte(body), &infos)).To(Succeed())
+		Expect(infos).To(Equal([]CollectorInfo{{
+			Name:    "custom_resource_info",
+			Type:    "*metrics.CRInfoGauge",
+			Handles: []string{"create", "update", "delete", "resync"},
+			Series:  1,
+		}}))
+	})
+})
+
+var _ = Describe("Server with additional gatherers", func() {
+	It("serves the families of every gatherer on one endpoint", func() {
+		registry := NewRegistry()
+		registry.MustRegister(NewCRInfoGauge())
+		obj := newMemcached("example")
+		registry.Predicate().Create(event.CreateEvent{Meta: obj, Object: obj})
+
+		other := prometheus.NewRegistry()
+		reconciles := prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "controller_runtime_reconcile_total",
+			Help: "Total number of reconciliations.",
+		})
+		other.MustRegister(reconciles)
+		reconciles.Inc()
+
+		addr := freeAddress()
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			defer GinkgoRecover()
+			Expect((&Server{
+				Gatherer:            registry,
+				AdditionalGatherers: []prometheus.Gatherer{other},
+				ListenAddress:       addr,
+			}).Start(stop)).To(Succeed())
+		}()
+
+		var resp *http.Response
+		Eventually(func() error {
+			var err error
+			resp, err = http.Get("http://" + addr + metricsPath)
+			return err
+		}).Should(Succeed())
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(string(body)).To(ContainSubstring("custom_resource_info{"))
+		Expect(string(body)).To(ContainSubstring("controller_runtime_reconcile_total 1"))
+	})
+})
+
+// blockingGatherer stalls every scrape until release is closed.
+type blockingGatherer struct {
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (g *blockingGatherer) Gather() ([]*dto.MetricFamily, error) {
+	g.entered <- struct{}{}
+	<-g.release
+	return nil, nil
+}
+
+var _ = Describe("Server shutdown", func() {
+	var (
+		addr     string
+		stop     chan struct{}
+		done     chan error
+		gatherer *blockingGatherer
+	)
+
+	BeforeEach(func() {
+		addr = freeAddress()
+		stop = make(chan struct{})
+		done = make(chan error, 1)
+		gatherer = &blockingGatherer{entered: make(chan struct{}, 2), release: make(chan struct{})}
+		s := &Server{
+			Gatherer:             gatherer,
+			ListenAddress:        addr,
+			ShutdownTimeout:      200 * time.Millisecond,
+			MaxConcurrentScrapes: 1,
+		}
+		go func() { done <- s.Start(stop) }()
+		Eventually(func() error {
+			_, err := http.Get("http://" + addr + healthzPath)
+			return err
+		}).Should(Succeed())
+	})
+
+	AfterEach(func() {
+		close(gatherer.release)
+	})
+
+	It("returns once the shutdown timeout expires with a scrape in flight", func() {
+		go http.Get("http://" + addr + metricsPath)
+		Eventually(gatherer.entered).Should(Receive())
+
+		close(stop)
+		Eventually(done, time.Second).Should(Receive(BeNil()))
+	})
+
+	It("returns once the shutdown timeout expires with an incomplete request", func() {
+		conn, err := net.Dial("tcp", addr)
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		_, err = conn.Write([]byte("GET " + metricsPath + " HTTP/1.1\r\nHost: metrics\r\n"))
+		Expect(err).NotTo(HaveOccurred())
+
+		close(stop)
+		Eventually(done, time.Second).Should(Receive(BeNil()))
+	})
+
+	It("rejects scrapes beyond the concurrency limit", func() {
+		go http.Get("http://" + addr + metricsPath)
+		Eventually(gatherer.entered).Should(Receive())
+
+		resp, err := http.Get("http://" + addr + metricsPath)
+		Expect(err).NotTo(HaveOccurred())
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusServiceUnavailable))
+
+		close(stop)
+		Eventually(done, time.Second).Should(Receive(BeNil()))
+	})
+})
@@ -0,0 +1,232 @@
+/*
+Copyright 2020 The Operator-SDK Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	cachev1alpha1 "github.com/bharathi-tenneti/memcached-operator-metrics/api/v1alpha1"
+)
+
+// summaryListTimeout bounds the cache list done on every scrape.
+const summaryListTimeout = 10 * time.Second
+
+// summarySizeBuckets are the upper bounds of the instance size
+// distributions.
+var summarySizeBuckets = []float64{1, 2, 3, 5, 8, 13, 21}
+
+// SummaryInfo exposes fleet-wide rollups of the Memcacheds in the cluster
+// and in each namespace. They are computed from the cache on every scrape,
+// so they always match the current objects without per-event bookkeeping.
+// Optionally it also exposes the deprecated per-object summary_info family.
+type SummaryInfo struct {
+	reader    client.Reader
+	fleet     summaryDescs
+	namespace summaryDescs
+	// legacy is the deprecated summary_info family, nil unless enabled.
+	legacy *prometheus.GaugeVec
+}
+
+// SummaryInfoOptions configures a SummaryInfo.
+type SummaryInfoOptions struct {
+	// LegacySummaryInfo keeps exporting summary_info, the time each object
+	// was last reconciled by the metrics controller.
+	LegacySummaryInfo bool
+}
+
+type summaryDescs struct {
+	instances, desired, ready, mismatch, size *prometheus.Desc
+}
+
+func newSummaryDescs(prefix, scope string, labels []string) summaryDescs {
+	return summaryDescs{
+		instances: prometheus.NewDesc(prefix+"_instances",
+			"Number of Memcacheds in the "+scope+".", labels, nil),
+		desired: prometheus.NewDesc(prefix+"_desired_replicas",
+			"Sum of the desired sizes of the Memcacheds in the "+scope+".", labels, nil),
+		ready: prometheus.NewDesc(prefix+"_ready_replicas",
+			"Sum of the ready replicas of the Memcacheds in the "+scope+".", labels, nil),
+		mismatch: prometheus.NewDesc(prefix+"_size_mismatch",
+			"Number of Memcacheds in the "+scope+" whose status nodes differ in number from their desired size.", labels, nil),
+		size: prometheus.NewDesc(prefix+"_size",
+			"Distribution of the desired sizes of the Memcacheds in the "+scope+".", labels, nil),
+	}
+}
+
+func (d summaryDescs) describe(ch chan<- *prometheus.Desc) {
+	ch <- d.instances
+	ch <- d.desired
+	ch <- d.ready
+	ch <- d.mismatch
+	ch <- d.size
+}
+
+// NewSummaryInfo returns a SummaryInfo listing Memcacheds from reader,
+// usually the manager's cache.
+func NewSummaryInfo(reader client.Reader, opts SummaryInfoOptions) *SummaryInfo {
+	s := &SummaryInfo{
+		reader:    reader,
+		fleet:     newSummaryDescs("memcached_fleet", "cluster", nil),
+		namespace: newSummaryDescs("memcached_namespace", "namespace", []string{"namespace"}),
+	}
+	if opts.LegacySummaryInfo {
+		s.legacy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "summary_info",
+			Help: "Deprecated: use the memcached_fleet_ and memcached_namespace_ families. Unix time of the last reconcile of a custom resource by the metrics controller.",
+		}, []string{"namespace", "name", "apiversion", "kind"})
+	}
+	return s
+}
+
+// Describe implements prometheus.Collector.
+func (s *SummaryInfo) Describe(ch chan<- *prometheus.Desc) {
+	s.fleet.describe(ch)
+	s.namespace.describe(ch)
+	if s.legacy != nil {
+		s.legacy.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector. The rollups are left out of the
+// scrape if the Memcacheds cannot be listed.
+func (s *SummaryInfo) Collect(ch chan<- prometheus.Metric) {
+	if s.legacy != nil {
+		s.legacy.Collect(ch)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), summaryListTimeout)
+	defer cancel()
+	list := &cachev1alpha1.MemcachedList{}
+	if err := s.reader.List(ctx, list); err != nil {
+		RecordError("memcached_fleet", err)
+		return
+	}
+
+	fleet := &rollup{}
+	namespaces := map[string]*rollup{}
+	for i := range list.Items {
+		m := &list.Items[i]
+		fleet.add(m)
+		r, ok := namespaces[m.Namespace]
+		if !ok {
+			r = &rollup{}
+			namespaces[m.Namespace] = r
+		}
+		r.add(m)
+	}
+	fleet.collect(ch, s.fleet)
+	for namespace, r := range namespaces {
+		r.collect(ch, s.namespace, namespace)
+	}
+}
+
+// SetLastReconcile sets the summary_info series of an object to now. It
+// does nothing unless the legacy family is enabled.
+func (s *SummaryInfo) SetLastReconcile(namespace, name, apiVersion, kind string) {
+	if s == nil || s.legacy == nil {
+		return
+	}
+	g, err := s.legacy.GetMetricWithLabelValues(namespace, name, apiVersion, kind)
+	if err != nil {
+		RecordError("summary_info", err, "namespace", namespace, "name", name)
+		return
+	}
+	g.SetToCurrentTime()
+}
+
+// Delete removes the summary_info series of a deleted Memcached, whatever
+// apiversion and kind it was labelled with.
+func (s *SummaryInfo) Delete(e event.DeleteEvent) {
+	if s.legacy == nil {
+		return
+	}
+	if _, ok := toMemcached(e.Object); !ok {
+		return
+	}
+	namespace, name := e.Meta.GetNamespace(), e.Meta.GetName()
+	pruneGaugeVec(s.legacy, func(l map[string]string) bool {
+		return l["namespace"] != namespace || l["name"] != name
+	})
+}
+
+// ResyncKinds implements KindedResyncHandler.
+func (s *SummaryInfo) ResyncKinds() []schema.GroupVersionKind {
+	return []schema.GroupVersionKind{memcachedGVK}
+}
+
+// Resync deletes the summary_info series of Memcacheds that no longer
+// exist. The rollups need no resync since they are computed on every
+// scrape.
+func (s *SummaryInfo) Resync(objs []runtime.Object) {
+	if s.legacy == nil {
+		return
+	}
+	keys := memcachedKeys(objs)
+	pruneGaugeVec(s.legacy, func(l map[string]string) bool {
+		return keys[objectKey(l["namespace"], l["name"])]
+	})
+}
+
+// rollup aggregates a set of Memcacheds.
+type rollup struct {
+	instances, desired, ready, mismatch float64
+	sizes                               []float64
+}
+
+func (r *rollup) add(m *cachev1alpha1.Memcached) {
+	r.instances++
+	r.desired += float64(m.Spec.Size)
+	r.ready += float64(m.Status.ReadyReplicas)
+	if int32(len(m.Status.Nodes)) != m.Spec.Size {
+		r.mismatch++
+	}
+	r.sizes = append(r.sizes, float64(m.Spec.Size))
+}
+
+func (r *rollup) collect(ch chan<- prometheus.Metric, d summaryDescs, labelValues ...string) {
+	ch <- prometheus.MustNewConstMetric(d.instances, prometheus.GaugeValue, r.instances, labelValues...)
+	ch <- prometheus.MustNewConstMetric(d.desired, prometheus.GaugeValue, r.desired, labelValues...)
+	ch <- prometheus.MustNewConstMetric(d.ready, prometheus.GaugeValue, r.ready, labelValues...)
+	ch <- prometheus.MustNewConstMetric(d.mismatch, prometheus.GaugeValue, r.mismatch, labelValues...)
+
+	buckets := make(map[float64]uint64, len(summarySizeBuckets))
+	for _, upper := range summarySizeBuckets {
+		buckets[upper] = 0
+	}
+	var sum float64
+	for _, size := range r.sizes {
+		sum += size
+		for _, upper := range summarySizeBuckets {
+			if size <= upper {
+				buckets[upper]++
+			}
+		}
+	}
+	h, err := prometheus.NewConstHistogram(d.size, uint64(len(r.sizes)), sum, buckets, labelValues...)
+	if err != nil {
+		RecordError("memcached_fleet", err, "labels", labelValues)
+		return
+	}
+	ch <- h
+}
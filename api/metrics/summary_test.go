@@ -0,0 +1,141 @@
+/*
+Copyright 2020 The Operator-SDK Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"context"
+	"fmt"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	cachev1alpha1 "github.com/bharathi-tenneti/memcached-operator-metrics/api/v1alpha1"
+)
+
+// failingReader fails every list.
+type failingReader struct {
+	client.Reader
+}
+
+func (failingReader) List(context.Context, runtime.Object, ...client.ListOption) error {
+	return fmt.Errorf("cache unavailable")
+}
+
+var _ = Describe("SummaryInfo", func() {
+	var scheme *runtime.Scheme
+
+	BeforeEach(func() {
+		scheme = runtime.NewScheme()
+		Expect(cachev1alpha1.AddToScheme(scheme)).To(Succeed())
+	})
+
+	memcached := func(namespace, name string, size, ready int32, nodes ...string) runtime.Object {
+		m := newMemcached(name)
+		m.Namespace = namespace
+		m.Spec.Size = size
+		m.Status.ReadyReplicas = ready
+		m.Status.Nodes = nodes
+		return m
+	}
+
+	It("rolls up the Memcacheds of the cluster and of each namespace", func() {
+		reader := fake.NewFakeClientWithScheme(scheme,
+			memcached("a", "one", 3, 3, "p1", "p2", "p3"),
+			memcached("a", "two", 2, 1, "p1"),
+			memcached("b", "three", 8, 0),
+		)
+		registry := NewRegistry()
+		registry.MustRegister(NewSummaryInfo(reader, SummaryInfoOptions{}))
+
+		for name, value := range map[string]float64{
+			"memcached_fleet_instances":        3,
+			"memcached_fleet_desired_replicas": 13,
+			"memcached_fleet_ready_replicas":   4,
+			"memcached_fleet_size_mismatch":    2,
+		} {
+			Expect(familySeries(registry, name)).To(Equal(map[string]float64{"": value}), name)
+		}
+		Expect(familySeries(registry, "memcached_namespace_desired_replicas")).To(Equal(map[string]float64{
+			"namespace=a": 5,
+			"namespace=b": 8,
+		}))
+		Expect(familySeries(registry, "memcached_namespace_size_mismatch")).To(Equal(map[string]float64{
+			"namespace=a": 1,
+			"namespace=b": 1,
+		}))
+
+		h := gatheredFamily(registry, "memcached_fleet_size").GetMetric()[0].GetHistogram()
+		Expect(h.GetSampleCount()).To(BeEquivalentTo(3))
+		Expect(h.GetSampleSum()).To(BeEquivalentTo(13))
+		cumulative := map[float64]uint64{}
+		for _, b := range h.GetBucket() {
+			cumulative[b.GetUpperBound()] = b.GetCumulativeCount()
+		}
+		Expect(cumulative).To(Equal(map[float64]uint64{1: 0, 2: 1, 3: 2, 5: 2, 8: 3, 13: 3, 21: 3}))
+	})
+
+	It("reflects objects created after registration on the next scrape", func() {
+		reader := fake.NewFakeClientWithScheme(scheme)
+		registry := NewRegistry()
+		registry.MustRegister(NewSummaryInfo(reader, SummaryInfoOptions{}))
+		Expect(familySeries(registry, "memcached_fleet_instances")).To(Equal(map[string]float64{"": 0}))
+
+		Expect(reader.Create(context.Background(), memcached("a", "one", 1, 0))).To(Succeed())
+
+		Expect(familySeries(registry, "memcached_fleet_instances")).To(Equal(map[string]float64{"": 1}))
+	})
+
+	It("leaves the rollups out of a scrape when the cache cannot be listed", func() {
+		registry := NewDefaultRegistry()
+		registry.MustRegister(NewSummaryInfo(failingReader{}, SummaryInfoOptions{}))
+		before := testutil.ToFloat64(metricsErrors.WithLabelValues("memcached_fleet"))
+
+		Expect(gatheredFamily(registry, "memcached_fleet_instances")).To(BeNil())
+		Expect(testutil.ToFloat64(metricsErrors.WithLabelValues("memcached_fleet"))).To(Equal(before + 1))
+	})
+
+	It("keeps the deprecated per-object family when enabled", func() {
+		registry := NewRegistry()
+		summary := NewSummaryInfo(fake.NewFakeClientWithScheme(scheme), SummaryInfoOptions{LegacySummaryInfo: true})
+		registry.MustRegister(summary)
+
+		summary.SetLastReconcile("default", "example", "cache.example.com/v1alpha1", "Memcached")
+		legacy := gatheredFamily(registry, "summary_info")
+		Expect(legacy.GetHelp()).To(HavePrefix("Deprecated:"))
+		Expect(legacy.GetMetric()).To(HaveLen(1))
+
+		obj := newMemcached("example")
+		registry.Predicate().Delete(event.DeleteEvent{Meta: obj, Object: obj})
+		Expect(gatheredFamily(registry, "summary_info")).To(BeNil())
+	})
+
+	It("prunes the per-object family of a deleted Memcached even if an object of another kind shares its name", func() {
+		registry := NewRegistry()
+		summary := NewSummaryInfo(fake.NewFakeClientWithScheme(scheme), SummaryInfoOptions{LegacySummaryInfo: true})
+		registry.MustRegister(summary)
+		summary.SetLastReconcile("default", "example", "cache.example.com/v1alpha1", "Memcached")
+
+		registry.Resync([]runtime.Object{newConfigMap("example")})
+
+		Expect(gatheredFamily(registry, "summary_info")).To(BeNil())
+	})
+})
@@ -0,0 +1,154 @@
+/*
+Copyright 2020 The Operator-SDK Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+const certReloadInterval = 10 * time.Second
+
+// certificateReloader serves a certificate and key pair from disk and
+// reloads it when either file changes, so rotated certificates are picked
+// up without a restart.
+type certificateReloader struct {
+	certFile string
+	keyFile  string
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	certStat fileStat
+	keyStat  fileStat
+}
+
+type fileStat struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFile(path string) (fileStat, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileStat{}, err
+	}
+	return fileStat{modTime: fi.ModTime(), size: fi.Size()}, nil
+}
+
+func newCertificateReloader(certFile, keyFile string) (*certificateReloader, error) {
+	c := &certificateReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload loads the pair if either file changed since the last load. It
+// reports whether a new certificate was loaded.
+func (c *certificateReloader) reload() (bool, error) {
+	certStat, err := statFile(c.certFile)
+	if err != nil {
+		return false, err
+	}
+	keyStat, err := statFile(c.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	c.mu.RLock()
+	unchanged := c.cert != nil && certStat == c.certStat && keyStat == c.keyStat
+	c.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return false, err
+	}
+	c.mu.Lock()
+	c.cert, c.certStat, c.keyStat = &cert, certStat, keyStat
+	c.mu.Unlock()
+	return true, nil
+}
+
+// watch reloads the pair every interval until stop is closed. A pair that
+// fails to load leaves the previous certificate in use.
+func (c *certificateReloader) watch(stop <-chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			reloaded, err := c.reload()
+			if err != nil {
+				log.Error(err, "unable to reload metrics server certificate", "cert", c.certFile, "key", c.keyFile)
+			} else if reloaded {
+				log.Info("reloaded metrics server certificate", "cert", c.certFile)
+			}
+		}
+	}
+}
+
+func (c *certificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// tlsConfig builds the server TLS configuration. It returns nil if the server
+// is not configured for TLS.
+func (s *Server) tlsConfig() (*tls.Config, *certificateReloader, error) {
+	if s.CertFile == "" && s.KeyFile == "" {
+		if s.ClientCAFile != "" {
+			return nil, nil, fmt.Errorf("client CA verification requires a certificate and key")
+		}
+		return nil, nil, nil
+	}
+	if s.CertFile == "" || s.KeyFile == "" {
+		return nil, nil, fmt.Errorf("both a certificate and a key are required to serve TLS")
+	}
+
+	certs, err := newCertificateReloader(s.CertFile, s.KeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.GetCertificate,
+	}
+	if s.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(s.ClientCAFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("no certificates found in %s", s.ClientCAFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, certs, nil
+}
@@ -0,0 +1,174 @@
+/*
+Copyright 2020 The Operator-SDK Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// Watcher feeds the events of arbitrary kinds to a predicate without a
+// reconciler, so metrics can be exposed for custom resources this operator
+// does not own. Kinds missing from Scheme are watched as unstructured, so
+// they need not be registered.
+type Watcher struct {
+	// Cache provides the informers, usually the manager's cache.
+	Cache cache.Cache
+	// Scheme decides whether a kind is watched as a typed or an
+	// unstructured object, like Resyncer.Scheme, so typed kinds share the
+	// informer their controllers already use.
+	Scheme *runtime.Scheme
+	// GroupVersionKinds are the kinds to watch.
+	GroupVersionKinds []schema.GroupVersionKind
+	// Predicate receives the events, usually Registry.Predicate().
+	Predicate predicate.Predicate
+}
+
+// NeedLeaderElection lets every replica keep its registry up to date.
+func (w *Watcher) NeedLeaderElection() bool {
+	return false
+}
+
+// Start registers an event handler on the informer of every kind and blocks
+// until stop is closed.
+func (w *Watcher) Start(stop <-chan struct{}) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	for _, gvk := range w.GroupVersionKinds {
+		obj, err := w.newObject(gvk)
+		if err != nil {
+			return fmt.Errorf("unable to watch %s: %v", gvk, err)
+		}
+		informer, err := w.Cache.GetInformer(ctx, obj)
+		if err != nil {
+			return fmt.Errorf("unable to watch %s: %v", gvk, err)
+		}
+		informer.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+			AddFunc:    w.onAdd,
+			UpdateFunc: w.onUpdate,
+			DeleteFunc: w.onDelete,
+		})
+		log.Info("watching kind for metrics", "gvk", gvk)
+	}
+
+	<-stop
+	return nil
+}
+
+// newObject returns an empty object of kind gvk, typed if the scheme
+// recognizes it.
+func (w *Watcher) newObject(gvk schema.GroupVersionKind) (runtime.Object, error) {
+	if w.Scheme != nil && w.Scheme.Recognizes(gvk) {
+		return w.Scheme.New(gvk)
+	}
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(gvk)
+	return obj, nil
+}
+
+func (w *Watcher) onAdd(obj interface{}) {
+	o, m, ok := objectMeta(obj)
+	if !ok {
+		return
+	}
+	w.Predicate.Create(event.CreateEvent{Meta: m, Object: o})
+}
+
+func (w *Watcher) onUpdate(oldObj, newObj interface{}) {
+	oldO, oldM, ok := objectMeta(oldObj)
+	if !ok {
+		return
+	}
+	newO, newM, ok := objectMeta(newObj)
+	if !ok {
+		return
+	}
+	w.Predicate.Update(event.UpdateEvent{MetaOld: oldM, ObjectOld: oldO, MetaNew: newM, ObjectNew: newO})
+}
+
+func (w *Watcher) onDelete(obj interface{}) {
+	e := event.DeleteEvent{}
+	// The informer hands out a tombstone when it missed the final state of
+	// a deleted object.
+	if tombstone, ok := obj.(toolscache.DeletedFinalStateUnknown); ok {
+		e.DeleteStateUnknown = true
+		obj = tombstone.Obj
+	}
+	o, m, ok := objectMeta(obj)
+	if !ok {
+		return
+	}
+	e.Meta, e.Object = m, o
+	w.Predicate.Delete(e)
+}
+
+func objectMeta(obj interface{}) (runtime.Object, metav1.Object, bool) {
+	o, ok := obj.(runtime.Object)
+	if !ok {
+		log.Error(nil, "informer delivered a non-object", "type", fmt.Sprintf("%T", obj))
+		return nil, nil, false
+	}
+	m, err := meta.Accessor(o)
+	if err != nil {
+		log.Error(err, "informer delivered an object without metadata", "type", fmt.Sprintf("%T", obj))
+		return nil, nil, false
+	}
+	return o, m, true
+}
+
+// ParseGroupVersionKinds parses a comma separated list of kinds in the form
+// group/version/Kind, or version/Kind for the core group.
+func ParseGroupVersionKinds(s string) ([]schema.GroupVersionKind, error) {
+	var gvks []schema.GroupVersionKind
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.Split(item, "/")
+		var gvk schema.GroupVersionKind
+		switch len(parts) {
+		case 2:
+			gvk = schema.GroupVersionKind{Version: parts[0], Kind: parts[1]}
+		case 3:
+			gvk = schema.GroupVersionKind{Group: parts[0], Version: parts[1], Kind: parts[2]}
+		default:
+			return nil, fmt.Errorf("invalid kind %q: expected group/version/Kind", item)
+		}
+		if gvk.Version == "" || gvk.Kind == "" {
+			return nil, fmt.Errorf("invalid kind %q: expected group/version/Kind", item)
+		}
+		gvks = append(gvks, gvk)
+	}
+	return gvks, nil
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2020 The Operator-SDK Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	cachev1alpha1 "github.com/bharathi-tenneti/memcached-operator-metrics/api/v1alpha1"
+)
+
+var _ = Describe("Watcher", func() {
+	var (
+		deletes []event.DeleteEvent
+		creates []event.CreateEvent
+		w       *Watcher
+		obj     *unstructured.Unstructured
+	)
+
+	BeforeEach(func() {
+		deletes, creates = nil, nil
+		w = &Watcher{Predicate: predicate.Funcs{
+			CreateFunc: func(e event.CreateEvent) bool { creates = append(creates, e); return true },
+			DeleteFunc: func(e event.DeleteEvent) bool { deletes = append(deletes, e); return true },
+		}}
+		obj = &unstructured.Unstructured{}
+		obj.SetAPIVersion("example.com/v1")
+		obj.SetKind("Widget")
+		obj.SetNamespace("default")
+		obj.SetName("example")
+	})
+
+	It("converts informer additions into create events", func() {
+		w.onAdd(obj)
+		Expect(creates).To(HaveLen(1))
+		Expect(creates[0].Meta.GetName()).To(Equal("example"))
+		Expect(creates[0].Object).To(BeIdenticalTo(obj))
+	})
+
+	It("unwraps tombstones into delete events with unknown state", func() {
+		w.onDelete(toolscache.DeletedFinalStateUnknown{Key: "default/example", Obj: obj})
+		Expect(deletes).To(HaveLen(1))
+		Expect(deletes[0].DeleteStateUnknown).To(BeTrue())
+		Expect(deletes[0].Meta.GetName()).To(Equal("example"))
+	})
+
+	It("ignores objects without metadata", func() {
+		w.onAdd("not an object")
+		Expect(creates).To(BeEmpty())
+	})
+
+	It("watches kinds known to the scheme as typed objects", func() {
+		w.Scheme = runtime.NewScheme()
+		Expect(cachev1alpha1.AddToScheme(w.Scheme)).To(Succeed())
+
+		typed, err := w.newObject(cachev1alpha1.GroupVersion.WithKind("Memcached"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(typed).To(BeAssignableToTypeOf(&cachev1alpha1.Memcached{}))
+
+		widget := schema.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Widget"}
+		untyped, err := w.newObject(widget)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(untyped.GetObjectKind().GroupVersionKind()).To(Equal(widget))
+		Expect(untyped).To(BeAssignableToTypeOf(&unstructured.Unstructured{}))
+	})
+})
+
+var _ = Describe("ParseGroupVersionKinds", func() {
+	It("parses grouped and core kinds", func() {
+		gvks, err := ParseGroupVersionKinds("example.com/v1/Widget, v1/ConfigMap")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(gvks).To(Equal([]schema.GroupVersionKind{
+			{Group: "example.com", Version: "v1", Kind: "Widget"},
+			{Version: "v1", Kind: "ConfigMap"},
+		}))
+	})
+
+	It("rejects malformed kinds", func() {
+		_, err := ParseGroupVersionKinds("Widget")
+		Expect(err).To(HaveOccurred())
+		_, err = ParseGroupVersionKinds("example.com/v1/")
+		Expect(err).To(HaveOccurred())
+	})
+})
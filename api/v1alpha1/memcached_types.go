@@ -39,6 +39,10 @@ type MemcachedStatus struct {
 	// Important: Run "make" to regenerate code after modifying this file
 	// Nodes are the names of the memcached pods
 	Nodes []string `json:"nodes"`
+	// ReadyReplicas is the number of ready memcached pods
+	ReadyReplicas int32 `json:"readyReplicas,omitempty"`
+	// ObservedGeneration is the generation of the spec the status reflects
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
 }
 
 // +kubebuilder:object:root=true
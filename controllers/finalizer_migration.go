@@ -0,0 +1,114 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	cachev1alpha1 "github.com/bharathi-tenneti/memcached-operator-metrics/api/v1alpha1"
+)
+
+// LegacyMetricsFinalizers were added to every Memcached by earlier releases
+// to delete metric series. Series are now removed from delete events and
+// resyncs, so the finalizers only block deletion while the operator is down.
+var LegacyMetricsFinalizers = []string{"cleanup-metrics", "cleanup-summary-metrics"}
+
+// FinalizerMigration strips LegacyMetricsFinalizers from existing Memcacheds
+// once the manager has started.
+type FinalizerMigration struct {
+	client.Client
+	Log logr.Logger
+}
+
+// NeedLeaderElection leaves the migration to the leader, the only replica
+// that writes to the cluster.
+func (m *FinalizerMigration) NeedLeaderElection() bool {
+	return true
+}
+
+// Start runs the migration once. Failures are logged rather than returned so
+// they do not stop the manager; objects left over are retried on the next
+// start.
+func (m *FinalizerMigration) Start(stop <-chan struct{}) error {
+	if err := m.Migrate(context.Background()); err != nil {
+		m.Log.Error(err, "Failed to remove legacy metrics finalizers")
+	}
+	return nil
+}
+
+// Migrate removes LegacyMetricsFinalizers from every Memcached that has
+// them. It returns the last error encountered after trying every object.
+func (m *FinalizerMigration) Migrate(ctx context.Context) error {
+	list := &cachev1alpha1.MemcachedList{}
+	if err := m.List(ctx, list); err != nil {
+		return err
+	}
+	var lastErr error
+	for i := range list.Items {
+		memcached := &list.Items[i]
+		if !hasAnyFinalizer(memcached.GetFinalizers(), LegacyMetricsFinalizers) {
+			continue
+		}
+		if err := m.removeFinalizers(ctx, memcached); client.IgnoreNotFound(err) != nil {
+			m.Log.Error(err, "Failed to remove legacy metrics finalizers", "Memcached.Namespace", memcached.Namespace, "Memcached.Name", memcached.Name)
+			lastErr = err
+			continue
+		}
+		m.Log.Info("Removed legacy metrics finalizers", "Memcached.Namespace", memcached.Namespace, "Memcached.Name", memcached.Name)
+	}
+	return lastErr
+}
+
+// removeFinalizers updates memcached without LegacyMetricsFinalizers. The
+// update fails on a stale resourceVersion rather than dropping finalizers
+// added since memcached was read, and is retried on a fresh copy.
+func (m *FinalizerMigration) removeFinalizers(ctx context.Context, memcached *cachev1alpha1.Memcached) error {
+	key := types.NamespacedName{Namespace: memcached.Namespace, Name: memcached.Name}
+	stale := false
+	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		if stale {
+			if err := m.Get(ctx, key, memcached); err != nil {
+				return err
+			}
+			if !hasAnyFinalizer(memcached.GetFinalizers(), LegacyMetricsFinalizers) {
+				return nil
+			}
+		}
+		stale = true
+		for _, f := range LegacyMetricsFinalizers {
+			controllerutil.RemoveFinalizer(memcached, f)
+		}
+		return m.Update(ctx, memcached)
+	})
+}
+
+func hasAnyFinalizer(finalizers, wanted []string) bool {
+	for _, f := range finalizers {
+		for _, w := range wanted {
+			if f == w {
+				return true
+			}
+		}
+	}
+	return false
+}
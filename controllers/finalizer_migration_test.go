@@ -0,0 +1,119 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	cachev1alpha1 "github.com/bharathi-tenneti/memcached-operator-metrics/api/v1alpha1"
+)
+
+// racingClient runs beforeUpdate ahead of the first Update, to change the
+// object behind the caller's back.
+type racingClient struct {
+	client.Client
+	beforeUpdate func()
+}
+
+func (c *racingClient) Update(ctx context.Context, obj runtime.Object, opts ...client.UpdateOption) error {
+	if f := c.beforeUpdate; f != nil {
+		c.beforeUpdate = nil
+		f()
+	}
+	return c.Client.Update(ctx, obj, opts...)
+}
+
+var _ = Describe("FinalizerMigration", func() {
+	var (
+		ctx       context.Context
+		migration *FinalizerMigration
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		migration = &FinalizerMigration{
+			Client: k8sClient,
+			Log:    ctrl.Log.WithName("controllers").WithName("FinalizerMigration"),
+		}
+	})
+
+	create := func(name string, finalizers ...string) types.NamespacedName {
+		obj := &cachev1alpha1.Memcached{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Finalizers: finalizers},
+			Spec:       cachev1alpha1.MemcachedSpec{Size: 1},
+		}
+		Expect(k8sClient.Create(ctx, obj)).To(Succeed())
+		return types.NamespacedName{Namespace: "default", Name: name}
+	}
+
+	It("strips the legacy finalizers and keeps all others", func() {
+		key := create("migrate-keep", "cleanup-metrics", "cleanup-summary-metrics", "example.com/other")
+
+		Expect(migration.Migrate(ctx)).To(Succeed())
+
+		obj := &cachev1alpha1.Memcached{}
+		Expect(k8sClient.Get(ctx, key, obj)).To(Succeed())
+		Expect(obj.Finalizers).To(Equal([]string{"example.com/other"}))
+
+		obj.Finalizers = nil
+		Expect(k8sClient.Update(ctx, obj)).To(Succeed())
+		Expect(k8sClient.Delete(ctx, obj)).To(Succeed())
+	})
+
+	It("keeps a finalizer added after the object was read", func() {
+		key := create("migrate-race", "cleanup-metrics")
+		migration.Client = &racingClient{Client: k8sClient, beforeUpdate: func() {
+			obj := &cachev1alpha1.Memcached{}
+			Expect(k8sClient.Get(ctx, key, obj)).To(Succeed())
+			obj.Finalizers = append(obj.Finalizers, "example.com/late")
+			Expect(k8sClient.Update(ctx, obj)).To(Succeed())
+		}}
+
+		Expect(migration.Migrate(ctx)).To(Succeed())
+
+		obj := &cachev1alpha1.Memcached{}
+		Expect(k8sClient.Get(ctx, key, obj)).To(Succeed())
+		Expect(obj.Finalizers).To(Equal([]string{"example.com/late"}))
+
+		obj.Finalizers = nil
+		Expect(k8sClient.Update(ctx, obj)).To(Succeed())
+		Expect(k8sClient.Delete(ctx, obj)).To(Succeed())
+	})
+
+	It("releases objects whose deletion was blocked by the legacy finalizers", func() {
+		key := create("migrate-deleting", "cleanup-metrics", "cleanup-summary-metrics")
+		obj := &cachev1alpha1.Memcached{}
+		Expect(k8sClient.Get(ctx, key, obj)).To(Succeed())
+		Expect(k8sClient.Delete(ctx, obj)).To(Succeed())
+		Expect(k8sClient.Get(ctx, key, obj)).To(Succeed())
+		Expect(obj.DeletionTimestamp).NotTo(BeNil())
+
+		Expect(migration.Migrate(ctx)).To(Succeed())
+
+		err := k8sClient.Get(ctx, key, &cachev1alpha1.Memcached{})
+		Expect(errors.IsNotFound(err)).To(BeTrue())
+	})
+})
@@ -30,7 +30,6 @@ import (
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
-	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 
 	"github.com/bharathi-tenneti/memcached-operator-metrics/api/metrics"
@@ -44,6 +43,7 @@ type MemcachedReconciler struct {
 	Scheme                  *runtime.Scheme
 	maxConcurrentReconciles int
 	TimeVec                 *metrics.TimeInfo
+	ReconcileMetrics        *metrics.ReconcileMetrics
 }
 
 // +kubebuilder:rbac:groups=cache.example.com,resources=memcacheds,verbs=get;list;watch;create;update;patch;delete
@@ -51,18 +51,25 @@ type MemcachedReconciler struct {
 // +kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;
 
-func (r *MemcachedReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+func (r *MemcachedReconciler) Reconcile(req ctrl.Request) (result ctrl.Result, err error) {
 	ctx := context.Background()
 	log := r.Log.WithValues("memcached", req.NamespacedName)
-
+	notFound := false
 	// Fetch the Memcached instance
 	memcached := &cachev1alpha1.Memcached{}
+	defer func() {
+		r.ReconcileMetrics.ObserveResult(req.Namespace, req.Name, memcached, reconcileResult(result, err, notFound))
+	}()
 
-	err := r.Get(ctx, req.NamespacedName, memcached)
+	done := r.ReconcileMetrics.StartPhase(req.Namespace, req.Name, memcached, metrics.PhaseFetch)
+	err = r.Get(ctx, req.NamespacedName, memcached)
+	done()
 	if err != nil {
 		if errors.IsNotFound(err) {
+			notFound = true
 			// Request object not found, could have been deleted after reconcile request.
-			// Owned objects are automatically garbage collected. For additional cleanup logic use finalizers.
+			// Owned objects are automatically garbage collected, and the metrics registry removes
+			// the series of a deleted Memcached, so no finalizer is needed.
 			// Return and don't requeue
 			log.Info("Memcached resource not found. Ignoring since object must be deleted")
 			return ctrl.Result{}, nil
@@ -72,38 +79,18 @@ func (r *MemcachedReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		return ctrl.Result{}, err
 	}
 
-	labels := map[string]string{
-		"name":      memcached.Name,
-		"namespace": memcached.Namespace,
-	}
-	m, metricErr := r.TimeVec.GetMetricWith(labels)
-	if metricErr != nil {
-		panic(metricErr)
-	}
-	// Delete metrics if no memcached resources are found.
-	if memcached.GetFinalizers() != nil && memcached.GetDeletionTimestamp() != nil {
-		for _, f := range memcached.GetFinalizers() {
-			if f == "cleanup-metrics" {
-				r.TimeVec.Delete(labels)
-				controllerutil.RemoveFinalizer(memcached, "cleanup-metrics")
-				r.Update(ctx, memcached)
-				return ctrl.Result{}, nil
-			}
-		}
-	}
-	// set the Finalizer and metrics for memcached
-	controllerutil.AddFinalizer(memcached, "cleanup-metrics")
-	r.Update(ctx, memcached)
-	m.SetToCurrentTime()
+	r.TimeVec.SetLastReconcile(memcached.Namespace, memcached.Name)
 
 	// Check if the deployment already exists, if not create a new one
 	found := &appsv1.Deployment{}
+	done = r.ReconcileMetrics.StartPhase(req.Namespace, req.Name, memcached, metrics.PhaseEnsureDeployment)
 	err = r.Get(ctx, types.NamespacedName{Name: memcached.Name, Namespace: memcached.Namespace}, found)
 	if err != nil && errors.IsNotFound(err) {
 		// Define a new deployment
 		dep := r.deploymentForMemcached(memcached)
 		log.Info("Creating a new Deployment", "Deployment.Namespace", dep.Namespace, "Deployment.Name", dep.Name)
 		err = r.Create(ctx, dep)
+		done()
 		if err != nil {
 			log.Error(err, "Failed to create new Deployment", "Deployment.Namespace", dep.Namespace, "Deployment.Name", dep.Name)
 			return ctrl.Result{}, err
@@ -111,7 +98,9 @@ func (r *MemcachedReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 
 		// Deployment created successfully - return and requeue
 		return ctrl.Result{Requeue: true}, nil
-	} else if err != nil {
+	}
+	done()
+	if err != nil {
 		log.Error(err, "Failed to get Deployment")
 		return ctrl.Result{}, err
 	}
@@ -120,7 +109,9 @@ func (r *MemcachedReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	size := memcached.Spec.Size
 	if *found.Spec.Replicas != size {
 		found.Spec.Replicas = &size
+		done = r.ReconcileMetrics.StartPhase(req.Namespace, req.Name, memcached, metrics.PhaseScale)
 		err = r.Update(ctx, found)
+		done()
 		if err != nil {
 			log.Error(err, "Failed to update Deployment", "Deployment.Namespace", found.Namespace, "Deployment.Name", found.Name)
 			return ctrl.Result{}, err
@@ -137,16 +128,26 @@ func (r *MemcachedReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		client.InNamespace(memcached.Namespace),
 		client.MatchingLabels(labelsForMemcached(memcached.Name)),
 	}
-	if err = r.List(ctx, podList, listOpts...); err != nil {
+	done = r.ReconcileMetrics.StartPhase(req.Namespace, req.Name, memcached, metrics.PhaseListPods)
+	err = r.List(ctx, podList, listOpts...)
+	done()
+	if err != nil {
 		log.Error(err, "Failed to list pods", "Memcached.Namespace", memcached.Namespace, "Memcached.Name", memcached.Name)
 		return ctrl.Result{}, err
 	}
 	podNames := getPodNames(podList.Items)
 
-	// Update status.Nodes if needed
-	if !reflect.DeepEqual(podNames, memcached.Status.Nodes) {
-		memcached.Status.Nodes = podNames
+	// Update the status if needed
+	status := cachev1alpha1.MemcachedStatus{
+		Nodes:              podNames,
+		ReadyReplicas:      found.Status.ReadyReplicas,
+		ObservedGeneration: memcached.Generation,
+	}
+	if !reflect.DeepEqual(status, memcached.Status) {
+		memcached.Status = status
+		done = r.ReconcileMetrics.StartPhase(req.Namespace, req.Name, memcached, metrics.PhaseStatusUpdate)
 		err := r.Status().Update(ctx, memcached)
+		done()
 		if err != nil {
 			log.Error(err, "Failed to update Memcached status")
 			return ctrl.Result{}, err
@@ -156,6 +157,20 @@ func (r *MemcachedReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	return ctrl.Result{}, nil
 }
 
+// reconcileResult classifies the outcome of a reconcile for ReconcileMetrics.
+func reconcileResult(result ctrl.Result, err error, notFound bool) string {
+	switch {
+	case err != nil:
+		return metrics.ReconcileError
+	case notFound:
+		return metrics.ReconcileNotFound
+	case result.Requeue || result.RequeueAfter > 0:
+		return metrics.ReconcileRequeue
+	default:
+		return metrics.ReconcileSuccess
+	}
+}
+
 // deploymentForMemcached returns a memcached Deployment object
 func (r *MemcachedReconciler) deploymentForMemcached(m *cachev1alpha1.Memcached) *appsv1.Deployment {
 	ls := labelsForMemcached(m.Name)
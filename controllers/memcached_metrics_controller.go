@@ -23,8 +23,10 @@ import (
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
-	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
 
 	"github.com/bharathi-tenneti/memcached-operator-metrics/api/metrics"
 	cachev1alpha1 "github.com/bharathi-tenneti/memcached-operator-metrics/api/v1alpha1"
@@ -55,7 +57,7 @@ func (r *MemcachedMetricsReconciler) Reconcile(req ctrl.Request) (ctrl.Result, e
 	if err != nil {
 		if errors.IsNotFound(err) {
 			// Request object not found, could have been deleted after reconcile request.
-			// Owned objects are automatically garbage collected. For additional cleanup logic use finalizers.
+			// Owned objects are automatically garbage collected.
 			// Return and don't requeue
 			log.Info("Memcached resource not found. Ignoring since object must be deleted")
 			return ctrl.Result{}, nil
@@ -65,38 +67,21 @@ func (r *MemcachedMetricsReconciler) Reconcile(req ctrl.Request) (ctrl.Result, e
 		return ctrl.Result{}, err
 	}
 
-	labels := map[string]string{
-		"name":       memcached.Name,
-		"namespace":  memcached.Namespace,
-		"apiversion": memcached.APIVersion,
-		"kind":       memcached.Kind,
+	// TypeMeta is usually empty on objects read from the cache, so the kind
+	// is resolved through the scheme to keep the labels stable.
+	gvk, gvkErr := apiutil.GVKForObject(memcached, r.Scheme)
+	if gvkErr != nil {
+		metrics.RecordError("summary_info", gvkErr, "memcached", req.NamespacedName)
+		return ctrl.Result{}, nil
 	}
-	m, metricErr := r.SummaryVec.GetMetricWith(labels)
-	if metricErr != nil {
-		panic(metricErr)
-	}
-	// Delete metrics if no memcached resources are found.
-	if memcached.GetFinalizers() != nil && memcached.GetDeletionTimestamp() != nil {
-		for _, f := range memcached.GetFinalizers() {
-			if f == "cleanup-summary-metrics" {
-				r.SummaryVec.Delete(labels)
-				controllerutil.RemoveFinalizer(memcached, "cleanup-summary-metrics")
-				r.Update(ctx, memcached)
-				return ctrl.Result{}, nil
-			}
-		}
-	}
-	// set the Finalizer and metrics for memcached
-	controllerutil.AddFinalizer(memcached, "cleanup-summary-metrics")
-	r.Update(ctx, memcached)
-	m.SetToCurrentTime()
+	r.SummaryVec.SetLastReconcile(memcached.Namespace, memcached.Name, gvk.GroupVersion().String(), gvk.Kind)
 	return ctrl.Result{}, nil
 }
 
 // SetupWithManager ...
-func (r *MemcachedMetricsReconciler) SetupWithManager(mgr ctrl.Manager) error {
+func (r *MemcachedMetricsReconciler) SetupWithManager(mgr ctrl.Manager, p ...predicate.Predicate) error {
 
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&cachev1alpha1.Memcached{}).
+		For(&cachev1alpha1.Memcached{}, builder.WithPredicates(p...)).
 		Complete(r)
 }
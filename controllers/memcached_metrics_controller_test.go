@@ -0,0 +1,161 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/bharathi-tenneti/memcached-operator-metrics/api/metrics"
+	cachev1alpha1 "github.com/bharathi-tenneti/memcached-operator-metrics/api/v1alpha1"
+)
+
+// summaryInfoLabels returns the labels of every summary_info series of the
+// named object.
+func summaryInfoLabels(g prometheus.Gatherer, namespace, name string) []map[string]string {
+	mfs, err := g.Gather()
+	Expect(err).NotTo(HaveOccurred())
+	var series []map[string]string
+	for _, mf := range mfs {
+		if mf.GetName() != "summary_info" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["namespace"] == namespace && labels["name"] == name {
+				series = append(series, labels)
+			}
+		}
+	}
+	return series
+}
+
+var _ = Describe("MemcachedMetricsReconciler", func() {
+	const timeout = 10 * time.Second
+
+	var (
+		ctx      context.Context
+		stop     chan struct{}
+		registry metrics.RegistererGathererPredicater
+	)
+
+	wantLabels := func(name string) []map[string]string {
+		return []map[string]string{{
+			"namespace":  "default",
+			"name":       name,
+			"apiversion": cachev1alpha1.GroupVersion.String(),
+			"kind":       "Memcached",
+		}}
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		mgr, err := ctrl.NewManager(cfg, ctrl.Options{
+			Scheme:             scheme.Scheme,
+			MetricsBindAddress: "0",
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		summaryInfo := metrics.NewSummaryInfo(mgr.GetCache(), metrics.SummaryInfoOptions{LegacySummaryInfo: true})
+		registry = metrics.NewRegistry()
+		registry.MustRegister(summaryInfo)
+		Expect((&MemcachedMetricsReconciler{
+			Client:     mgr.GetClient(),
+			Log:        ctrl.Log.WithName("controllers").WithName("Memcached_metrics"),
+			Scheme:     mgr.GetScheme(),
+			SummaryVec: summaryInfo,
+		}).SetupWithManager(mgr, registry.Predicate())).To(Succeed())
+
+		stop = make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			Expect(mgr.Start(stop)).To(Succeed())
+		}()
+	})
+
+	AfterEach(func() {
+		close(stop)
+	})
+
+	newMemcached := func(name string) *cachev1alpha1.Memcached {
+		return &cachev1alpha1.Memcached{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec:       cachev1alpha1.MemcachedSpec{Size: 1},
+		}
+	}
+
+	It("labels summary_info with the kind of a created object", func() {
+		obj := newMemcached("gvk-create")
+		Expect(k8sClient.Create(ctx, obj)).To(Succeed())
+
+		Eventually(func() []map[string]string {
+			return summaryInfoLabels(registry, "default", "gvk-create")
+		}, timeout).Should(Equal(wantLabels("gvk-create")))
+	})
+
+	It("keeps a single labelled series across updates", func() {
+		obj := newMemcached("gvk-update")
+		Expect(k8sClient.Create(ctx, obj)).To(Succeed())
+		Eventually(func() []map[string]string {
+			return summaryInfoLabels(registry, "default", "gvk-update")
+		}, timeout).Should(Equal(wantLabels("gvk-update")))
+
+		key := types.NamespacedName{Namespace: "default", Name: "gvk-update"}
+		Eventually(func() error {
+			current := &cachev1alpha1.Memcached{}
+			if err := k8sClient.Get(ctx, key, current); err != nil {
+				return err
+			}
+			current.Spec.Size = 3
+			return k8sClient.Update(ctx, current)
+		}, timeout).Should(Succeed())
+
+		Consistently(func() []map[string]string {
+			return summaryInfoLabels(registry, "default", "gvk-update")
+		}, time.Second).Should(Equal(wantLabels("gvk-update")))
+	})
+
+	It("deletes the labelled series of a deleted object", func() {
+		obj := newMemcached("gvk-delete")
+		Expect(k8sClient.Create(ctx, obj)).To(Succeed())
+		Eventually(func() []map[string]string {
+			return summaryInfoLabels(registry, "default", "gvk-delete")
+		}, timeout).Should(Equal(wantLabels("gvk-delete")))
+
+		Expect(k8sClient.Delete(ctx, obj)).To(Succeed())
+
+		Eventually(func() bool {
+			err := k8sClient.Get(ctx, types.NamespacedName{Namespace: "default", Name: "gvk-delete"}, &cachev1alpha1.Memcached{})
+			return errors.IsNotFound(err)
+		}, timeout).Should(BeTrue())
+		Eventually(func() []map[string]string {
+			return summaryInfoLabels(registry, "default", "gvk-delete")
+		}, timeout).Should(BeEmpty())
+	})
+})
@@ -19,12 +19,17 @@ package main
 import (
 	"flag"
 	"os"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 
 	"github.com/bharathi-tenneti/memcached-operator-metrics/api/metrics"
@@ -51,8 +56,84 @@ func init() {
 
 func main() {
 	var metricsAddr string
+	var metricsConfig string
+	var metricsWatchKinds string
+	var metricsResyncPeriod time.Duration
+	var customMetricsCertFile, customMetricsKeyFile, customMetricsClientCAFile string
+	var customMetricsAuth bool
+	var customMetricsShutdownTimeout time.Duration
+	var customMetricsMaxScrapes int
+	var mergeMetrics bool
+	var legacyCRInfo bool
+	var legacySizeInfo bool
+	var legacySummaryInfo bool
+	var labelsAllowlist, annotationsAllowlist string
+	var metricsPushURL, metricsPushMode, metricsPushLabels string
+	var metricsPushInterval time.Duration
+	var otlpEndpoint, otlpProtocol, otlpClusterName string
+	var otlpInsecure bool
+	var otlpInterval time.Duration
 	var enableLeaderElection bool
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
+	flag.StringVar(&metricsConfig, "metrics-config", "",
+		"Path to a YAML file describing additional metric families generated from custom resources. "+
+			"The kinds its families use when the operator starts are watched like --metrics-watch-kinds; "+
+			"a reload that adds another kind is rejected until the operator restarts.")
+	flag.StringVar(&metricsWatchKinds, "metrics-watch-kinds", "",
+		"Comma separated list of additional kinds (group/version/Kind) to watch for metrics only. "+
+			"The manager needs RBAC permission to list and watch them.")
+	flag.DurationVar(&metricsResyncPeriod, "metrics-resync-period", 5*time.Minute,
+		"How often custom resource metrics are recomputed from the cache. Series of deleted objects are removed.")
+	flag.StringVar(&customMetricsCertFile, "custom-metrics-cert-file", "",
+		"Certificate to serve the custom resource metrics endpoint over HTTPS. Reloaded when it changes.")
+	flag.StringVar(&customMetricsKeyFile, "custom-metrics-key-file", "",
+		"Private key matching --custom-metrics-cert-file.")
+	flag.StringVar(&customMetricsClientCAFile, "custom-metrics-client-ca-file", "",
+		"If set, clients of the custom resource metrics endpoint must present a certificate signed by this CA.")
+	flag.BoolVar(&customMetricsAuth, "custom-metrics-auth", false,
+		"Authenticate and authorize requests to the custom resource metrics endpoint "+
+			"with TokenReviews and SubjectAccessReviews.")
+	flag.DurationVar(&customMetricsShutdownTimeout, "custom-metrics-shutdown-timeout", 5*time.Second,
+		"How long in-flight requests to the custom resource metrics endpoint are drained on shutdown.")
+	flag.IntVar(&customMetricsMaxScrapes, "custom-metrics-max-concurrent-scrapes", 0,
+		"Maximum number of concurrent scrapes of the custom resource metrics endpoint. 0 means no limit.")
+	flag.BoolVar(&mergeMetrics, "merge-metrics", false,
+		"Serve the controller-runtime metrics on the custom resource metrics endpoint too, "+
+			"instead of on --metrics-addr, so a single scrape job covers both.")
+	flag.BoolVar(&legacyCRInfo, "metrics-legacy-cr-info", true,
+		"Keep exporting the deprecated custom_resource_info family alongside memcached_info and memcached_created. "+
+			"Deprecated: the family and this flag will be removed in the next release.")
+	flag.BoolVar(&legacySizeInfo, "metrics-legacy-size-info", true,
+		"Keep exporting the deprecated size_info family alongside memcached_last_reconcile_timestamp_seconds. "+
+			"Deprecated: the family and this flag will be removed in the next release.")
+	flag.BoolVar(&legacySummaryInfo, "metrics-legacy-summary-info", true,
+		"Keep exporting the deprecated per-object summary_info family alongside the memcached_fleet_ and memcached_namespace_ rollups. "+
+			"Deprecated: the family and this flag will be removed in the next release.")
+	flag.StringVar(&labelsAllowlist, "metric-labels-allowlist", "",
+		"Kubernetes label keys exposed by memcached_labels, e.g. memcacheds=[team,env]. Only listed keys are exposed. "+
+			"Keys are sanitized into valid metric label names prefixed with label_.")
+	flag.StringVar(&annotationsAllowlist, "metric-annotations-allowlist", "",
+		"Kubernetes annotation keys exposed by memcached_annotations, e.g. memcacheds=[owner]. Only listed keys are exposed. "+
+			"Keys are sanitized into valid metric label names prefixed with annotation_.")
+	flag.StringVar(&metricsPushURL, "metrics-push-url", "",
+		"If set, the leader pushes the custom resource metrics to this Pushgateway or remote-write URL.")
+	flag.StringVar(&metricsPushMode, "metrics-push-mode", string(metrics.PushGateway),
+		"Protocol used with --metrics-push-url: pushgateway or remote-write.")
+	flag.DurationVar(&metricsPushInterval, "metrics-push-interval", time.Minute,
+		"How often metrics are pushed to --metrics-push-url.")
+	flag.StringVar(&metricsPushLabels, "metrics-push-labels", "",
+		"Comma separated name=value labels added to pushed metrics, e.g. cluster=east.")
+	flag.StringVar(&otlpEndpoint, "otlp-endpoint", "",
+		"If set, the leader exports the custom resource metrics to this OpenTelemetry collector: "+
+			"host:port for grpc, a URL for http/protobuf.")
+	flag.StringVar(&otlpProtocol, "otlp-protocol", string(metrics.OTLPGRPC),
+		"Protocol used with --otlp-endpoint: grpc or http/protobuf.")
+	flag.BoolVar(&otlpInsecure, "otlp-insecure", false,
+		"Export over gRPC without TLS.")
+	flag.StringVar(&otlpClusterName, "otlp-cluster-name", "",
+		"Value of the k8s.cluster.name resource attribute of exported metrics.")
+	flag.DurationVar(&otlpInterval, "otlp-interval", time.Minute,
+		"How often metrics are exported to --otlp-endpoint.")
 	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
@@ -60,6 +141,11 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
 
+	if mergeMetrics {
+		// "0" disables controller-runtime's own metrics listener.
+		metricsAddr = "0"
+	}
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:             scheme,
 		MetricsBindAddress: metricsAddr,
@@ -72,28 +158,158 @@ func main() {
 		os.Exit(1)
 	}
 
-	if err := mgr.Add(&metrics.Server{
+	resyncer := &metrics.Resyncer{
+		Cache:             mgr.GetCache(),
+		Scheme:            mgr.GetScheme(),
+		GroupVersionKinds: []schema.GroupVersionKind{cachev1alpha1.GroupVersion.WithKind("Memcached")},
+		Registry:          metricsRegistry,
+		Interval:          metricsResyncPeriod,
+	}
+	metricsServer := &metrics.Server{
 		Gatherer:      metricsRegistry,
 		ListenAddress: "0.0.0.0:8686",
-	}); err != nil {
+		CertFile:      customMetricsCertFile,
+		KeyFile:       customMetricsKeyFile,
+		ClientCAFile:  customMetricsClientCAFile,
+		Ready:         resyncer.Ready,
+
+		ShutdownTimeout:      customMetricsShutdownTimeout,
+		MaxConcurrentScrapes: customMetricsMaxScrapes,
+	}
+	if mergeMetrics {
+		metricsServer.AdditionalGatherers = []prometheus.Gatherer{ctrlmetrics.Registry}
+	}
+	if customMetricsAuth {
+		clientset, err := kubernetes.NewForConfig(mgr.GetConfig())
+		if err != nil {
+			setupLog.Error(err, "unable to create client for metrics authentication")
+			os.Exit(1)
+		}
+		metricsServer.Authenticator = &metrics.TokenAuthenticator{Client: clientset}
+	}
+	if err := mgr.Add(metricsServer); err != nil {
 		os.Exit(1)
 	}
-	crInfo := metrics.NewCRInfoGauge()
-	timeInfo := metrics.NewTimeInfo()
-	summaryInfo := metrics.NewSummaryInfo()
+	if metricsPushURL != "" {
+		pushLabels, err := metrics.ParseLabels(metricsPushLabels)
+		if err != nil {
+			setupLog.Error(err, "invalid --metrics-push-labels")
+			os.Exit(1)
+		}
+		if err := mgr.Add(&metrics.Pusher{
+			Gatherer: metricsRegistry,
+			URL:      metricsPushURL,
+			Mode:     metrics.PushMode(metricsPushMode),
+			Labels:   pushLabels,
+			Interval: metricsPushInterval,
+		}); err != nil {
+			setupLog.Error(err, "unable to add metrics pusher")
+			os.Exit(1)
+		}
+	}
+	if otlpEndpoint != "" {
+		// POD_NAME and POD_NAMESPACE are set through the downward API.
+		attrs := map[string]string{
+			metrics.OTLPServiceName:      "memcached-operator",
+			metrics.OTLPK8sPodName:       os.Getenv("POD_NAME"),
+			metrics.OTLPK8sNamespaceName: os.Getenv("POD_NAMESPACE"),
+			metrics.OTLPK8sClusterName:   otlpClusterName,
+		}
+		for k, v := range attrs {
+			if v == "" {
+				delete(attrs, k)
+			}
+		}
+		if err := mgr.Add(&metrics.OTLPExporter{
+			Gatherer:           metricsRegistry,
+			Endpoint:           otlpEndpoint,
+			Protocol:           metrics.OTLPProtocol(otlpProtocol),
+			Insecure:           otlpInsecure,
+			ResourceAttributes: attrs,
+			Interval:           otlpInterval,
+		}); err != nil {
+			setupLog.Error(err, "unable to add OTLP exporter")
+			os.Exit(1)
+		}
+	}
+	timeInfo := metrics.NewTimeInfo(metrics.TimeInfoOptions{LegacySizeInfo: legacySizeInfo})
+	summaryInfo := metrics.NewSummaryInfo(mgr.GetCache(), metrics.SummaryInfoOptions{LegacySummaryInfo: legacySummaryInfo})
 
-	metricsRegistry.MustRegister(crInfo)
+	memcachedOpts := metrics.MemcachedCollectorOptions{
+		LabelsAllowlist:      memcachedAllowlist("metric-labels-allowlist", labelsAllowlist),
+		AnnotationsAllowlist: memcachedAllowlist("metric-annotations-allowlist", annotationsAllowlist),
+	}
+	metricsRegistry.MustRegister(metrics.NewMemcachedCollector(memcachedOpts))
+	if legacyCRInfo {
+		metricsRegistry.MustRegister(metrics.NewCRInfoGauge())
+	}
 	metricsRegistry.MustRegister(timeInfo)
 	metricsRegistry.MustRegister(summaryInfo)
+	reconcileMetrics := metrics.NewReconcileMetrics()
+	metricsRegistry.MustRegister(reconcileMetrics)
+
+	// Memcached events reach the registry through its controller. Any other
+	// kind named by --metrics-watch-kinds or by a family in the metrics
+	// config is watched for metrics only.
+	watchKinds, err := metrics.ParseGroupVersionKinds(metricsWatchKinds)
+	if err != nil {
+		setupLog.Error(err, "invalid --metrics-watch-kinds")
+		os.Exit(1)
+	}
+	if metricsConfig != "" {
+		cfg, err := metrics.LoadConfig(metricsConfig)
+		if err != nil {
+			setupLog.Error(err, "unable to load metrics config", "path", metricsConfig)
+			os.Exit(1)
+		}
+		watchKinds = append(watchKinds, cfg.GroupVersionKinds()...)
+	}
+	watchKinds = extraKinds(watchKinds, resyncer.GroupVersionKinds)
+	if len(watchKinds) > 0 {
+		if err := mgr.Add(&metrics.Watcher{
+			Cache:             mgr.GetCache(),
+			Scheme:            mgr.GetScheme(),
+			GroupVersionKinds: watchKinds,
+			Predicate:         metricsRegistry.Predicate(),
+		}); err != nil {
+			setupLog.Error(err, "unable to add metrics watcher")
+			os.Exit(1)
+		}
+		resyncer.ExtraGroupVersionKinds = watchKinds
+	}
+
+	if metricsConfig != "" {
+		reloader := &metrics.ConfigReloader{
+			Path:         metricsConfig,
+			Registry:     metricsRegistry,
+			Scheme:       mgr.GetScheme(),
+			Reader:       mgr.GetAPIReader(),
+			WatchedKinds: append(resyncer.GroupVersionKinds, resyncer.ExtraGroupVersionKinds...),
+		}
+		if err := reloader.Load(); err != nil {
+			setupLog.Error(err, "unable to load metrics config", "path", metricsConfig)
+			os.Exit(1)
+		}
+		if err := mgr.Add(reloader); err != nil {
+			setupLog.Error(err, "unable to add metrics config reloader")
+			os.Exit(1)
+		}
+	}
+
+	if err := mgr.Add(resyncer); err != nil {
+		setupLog.Error(err, "unable to add metrics resyncer")
+		os.Exit(1)
+	}
 
 	var predicates []predicate.Predicate
-	predicates = append(predicates, metricsRegistry.Predicate())
+	predicates = append(predicates, metricsRegistry.FilterPredicate(metrics.MatchAll))
 
 	if err = (&controllers.MemcachedReconciler{
-		Client:  mgr.GetClient(),
-		Log:     ctrl.Log.WithName("controllers").WithName("Memcached"),
-		Scheme:  mgr.GetScheme(),
-		TimeVec: timeInfo,
+		Client:           mgr.GetClient(),
+		Log:              ctrl.Log.WithName("controllers").WithName("Memcached"),
+		Scheme:           mgr.GetScheme(),
+		TimeVec:          timeInfo,
+		ReconcileMetrics: reconcileMetrics,
 	}).SetupWithManager(mgr, predicates...); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Memcached")
 		os.Exit(1)
@@ -110,6 +326,14 @@ func main() {
 		os.Exit(1)
 	}
 
+	if err := mgr.Add(&controllers.FinalizerMigration{
+		Client: mgr.GetClient(),
+		Log:    ctrl.Log.WithName("controllers").WithName("FinalizerMigration"),
+	}); err != nil {
+		setupLog.Error(err, "unable to add finalizer migration")
+		os.Exit(1)
+	}
+
 	// +kubebuilder:scaffold:builder
 
 	setupLog.Info("starting manager")
@@ -118,3 +342,36 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// memcachedAllowlist parses the value of an allowlist flag and returns the
+// keys allowed for memcacheds, exiting on invalid values.
+func memcachedAllowlist(flagName, value string) []string {
+	allowlist, err := metrics.ParseAllowlist(value)
+	if err != nil {
+		setupLog.Error(err, "invalid --"+flagName)
+		os.Exit(1)
+	}
+	for resource := range allowlist {
+		if resource != "memcacheds" {
+			setupLog.Error(nil, "unknown resource in --"+flagName, "resource", resource)
+			os.Exit(1)
+		}
+	}
+	return allowlist["memcacheds"]
+}
+
+// extraKinds returns the distinct kinds in kinds that are not in watched.
+func extraKinds(kinds, watched []schema.GroupVersionKind) []schema.GroupVersionKind {
+	seen := map[schema.GroupVersionKind]bool{}
+	for _, gvk := range watched {
+		seen[gvk] = true
+	}
+	var extra []schema.GroupVersionKind
+	for _, gvk := range kinds {
+		if !seen[gvk] {
+			seen[gvk] = true
+			extra = append(extra, gvk)
+		}
+	}
+	return extra
+}